@@ -12,8 +12,8 @@ func main() {
 	cache := rwfs.NewFileCache()
 
 	// Create MemFile instances
-	memFile1 := rwfs.NewMemFile("key1", "", rwfs.FilePermission{})
-	memFile2 := rwfs.NewMemFile("key2", "", rwfs.FilePermission{})
+	memFile1 := rwfs.NewMemFile("key1", "", rwfs.ReadWrite)
+	memFile2 := rwfs.NewMemFile("key2", "", rwfs.ReadWrite)
 
 	// Put MemFile instances into the cache
 	cache.Put("key1", memFile1, false) // Not dirty
@@ -24,13 +24,13 @@ func main() {
 	data2, exists2 := cache.Get("key2")
 
 	if exists1 {
-		fmt.Printf("Data for key1: %s\n", data1)
+		fmt.Printf("Data for key1: %s\n", data1.Bytes())
 	} else {
 		fmt.Println("Data for key1 not found in cache")
 	}
 
 	if exists2 {
-		fmt.Printf("Data for key2: %s\n", data2.Data.Bytes())
+		fmt.Printf("Data for key2: %s\n", data2.Bytes())
 	} else {
 		fmt.Println("Data for key2 not found in cache")
 	}
@@ -41,7 +41,7 @@ func main() {
 	// Check if the cached data expired
 	data1, exists1 = cache.Get("key1")
 	if exists1 {
-		fmt.Printf("Data for key1: %s\n", data1.Data.Bytes())
+		fmt.Printf("Data for key1: %s\n", data1.Bytes())
 	} else {
 		fmt.Println("Data for key1 expired from cache")
 	}
@@ -52,7 +52,7 @@ func main() {
 	// Try to retrieve data that has been removed
 	data2, exists2 = cache.Get("key2")
 	if exists2 {
-		fmt.Printf("Data for key2: %s\n", data2.Data.Bytes())
+		fmt.Printf("Data for key2: %s\n", data2.Bytes())
 	} else {
 		fmt.Println("Data for key2 not found in cache (removed)")
 	}
@@ -34,7 +34,7 @@ func main() {
 	}
 
 	// Create a new file
-	file, err := fs.CreateFile("example_file.txt", "owner1", rwfs.FilePermission{})
+	file, err := fs.CreateFile("example_file.txt", "owner1", rwfs.ReadWrite)
 	if err != nil {
 		log.Fatalf("Failed to create file: %v", err)
 	}
@@ -0,0 +1,97 @@
+package rwfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// backupName returns the name of the given backup generation of a snapshot,
+// e.g. data.rwfs.1 for the most recent one
+func backupName(name string, generation int) string {
+	return name + "." + strconv.Itoa(generation)
+}
+
+// writeFileAtomic replaces the file name with the output of write. The data is
+// written to a temporary file in the same directory and synced to disk before
+// it is renamed over name, so a crash leaves either the old or the new file
+// in place. When generations is positive, the replaced file is kept as the
+// newest of that many numbered backups.
+func writeFileAtomic(name string, generations int, write func(io.Writer) error) error {
+	_, err := replaceFile(name, generations, write)
+	return err
+}
+
+// replaceFile implements writeFileAtomic. It also reports whether name was
+// replaced, which is the case if only syncing the directory failed.
+func replaceFile(name string, generations int, write func(io.Writer) error) (renamed bool, err error) {
+	dir := filepath.Dir(name)
+	tmp, err := os.CreateTemp(dir, filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil && !renamed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = write(tmp); err != nil {
+		return false, err
+	}
+	if err = tmp.Sync(); err != nil {
+		return false, err
+	}
+	if err = tmp.Close(); err != nil {
+		return false, err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return false, err
+	}
+	if generations > 0 {
+		if err = rotateBackups(name, generations); err != nil {
+			return false, err
+		}
+	}
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		return false, err
+	}
+	return true, syncDir(dir)
+}
+
+// rotateBackups shifts the numbered backups of name by one generation, dropping
+// the oldest, and keeps the current file as generation 1
+func rotateBackups(name string, generations int) error {
+	if _, err := os.Stat(name); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	for i := generations - 1; i >= 1; i-- {
+		err := os.Rename(backupName(name, i), backupName(name, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	newest := backupName(name, 1)
+	if err := os.Remove(newest); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// Prefer a hard link so that name stays in place until the new file is
+	// renamed over it
+	if err := os.Link(name, newest); err != nil {
+		return os.Rename(name, newest)
+	}
+	return nil
+}
+
+// syncDir flushes the directory entry changes of dir to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
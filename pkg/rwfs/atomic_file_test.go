@@ -0,0 +1,180 @@
+package rwfs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeVersions saves a file system with /v1 and then with /v1 and /v2 to
+// the snapshot file of config, leaving the first one as the newest backup
+func writeVersions(t *testing.T, config FileSystemConfig) *LocalFileSystem {
+	t.Helper()
+	fs, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/v1", "/v2"} {
+		if _, err := fs.CreateFile(name, "", ReadWrite); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fs
+}
+
+func TestBackupGenerations(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "data.rwfs")
+	fs, err := NewLocalFileSystem(FileSystemConfig{BackupGenerations: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := fs.SaveToFile(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, generation := range []string{name, backupName(name, 1), backupName(name, 2)} {
+		if _, err := os.Stat(generation); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(backupName(name, 3)); !os.IsNotExist(err) {
+		t.Errorf("third generation kept: Stat error = %v", err)
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*.tmp-*"))
+	if err != nil || len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestBackupFallback(t *testing.T) {
+	// corrupt flips a byte in the middle of the payload, or cuts the payload
+	// in half and fixes up the checksum if fix is set, so that only decoding
+	// the payload fails
+	corrupt := func(data []byte, fix bool) []byte {
+		start, end := payloadOffset(data), len(data)-sha256.Size
+		if !fix {
+			data[(start+end)/2] ^= 0x40
+			return data
+		}
+		data = data[:(start+end)/2]
+		checksum := sha256.Sum256(data)
+		return append(data, checksum[:]...)
+	}
+	for _, test := range []struct {
+		name string
+		fix  bool
+		want error
+	}{
+		{"checksum", false, ErrSnapshotChecksum},
+		{"payload", true, ErrSnapshotCorrupt},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := FileSystemConfig{Filepath: filepath.Join(t.TempDir(), "data.rwfs"), BackupGenerations: 2}
+			writeVersions(t, config)
+			data, err := os.ReadFile(config.Filepath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = corrupt(data, test.fix)
+			if err := os.WriteFile(config.Filepath, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			fs, err := NewLocalFileSystem(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fs.Stat("/v1"); err != nil {
+				t.Errorf("backup was not loaded: %v", err)
+			}
+			if _, err := fs.Stat("/v2"); !os.IsNotExist(err) {
+				t.Errorf("Stat(/v2) error = %v, want not exist", err)
+			}
+
+			// Without backups the corruption is reported
+			config.BackupGenerations = 0
+			if _, err := NewLocalFileSystem(config); !errors.Is(err, test.want) {
+				t.Errorf("no backups: error = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestBackupFallbackMissingPrimary(t *testing.T) {
+	config := FileSystemConfig{Filepath: filepath.Join(t.TempDir(), "data.rwfs"), BackupGenerations: 2}
+	writeVersions(t, config)
+	if err := os.Remove(config.Filepath); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/v1"); err != nil {
+		t.Errorf("backup was not loaded: %v", err)
+	}
+}
+
+func TestBackupNoFallbackOnKeyErrors(t *testing.T) {
+	config := FileSystemConfig{
+		Filepath:          filepath.Join(t.TempDir(), "data.rwfs"),
+		BackupGenerations: 2,
+		Encryption:        true,
+		EncryptionKey:     "old",
+		KeyIterations:     1000,
+	}
+	fs := writeVersions(t, config)
+	if err := fs.RotateKey("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backups still open with the old key, but they are stale
+	_, err := NewLocalFileSystem(config)
+	var mismatch *KeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("old key after rotation: error = %v, want KeyMismatchError", err)
+	}
+	if mismatch.KeyID != fs.KeyID() {
+		t.Errorf("KeyID = %s, want %s", mismatch.KeyID, fs.KeyID())
+	}
+
+	plain := FileSystemConfig{Filepath: config.Filepath, BackupGenerations: 2}
+	if _, err := NewLocalFileSystem(plain); !errors.Is(err, ErrKeyRequired) {
+		t.Errorf("no key: error = %v, want ErrKeyRequired", err)
+	}
+
+	config.EncryptionKey = "new"
+	reopened, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Stat("/v2"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBackupNoFallbackOnVersion(t *testing.T) {
+	// A snapshot written by a newer version is not damaged, and loading an
+	// older backup in its place would lose its contents
+	config := FileSystemConfig{Filepath: filepath.Join(t.TempDir(), "data.rwfs"), BackupGenerations: 2}
+	writeVersions(t, config)
+	data, err := os.ReadFile(config.Filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint16(data[4:], snapshotVersion+1)
+	if err := os.WriteFile(config.Filepath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewLocalFileSystem(config); !errors.Is(err, ErrSnapshotVersion) {
+		t.Errorf("newer snapshot: error = %v, want ErrSnapshotVersion", err)
+	}
+}
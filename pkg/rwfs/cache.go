@@ -1,6 +1,7 @@
 package rwfs
 
 import (
+	"strings"
 	"sync"
 	"time"
 )
@@ -72,3 +73,26 @@ func (cache *FileCache) Remove(name string) {
 
 	delete(cache.entries, name)
 }
+
+// Rename moves the entry cached under oldName, and every entry below it when
+// oldName is a directory, to newName
+func (cache *FileCache) Rename(oldName, newName string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	prefix := strings.TrimSuffix(oldName, "/") + "/"
+	moved := make(map[string]*CacheEntry)
+	for name, entry := range cache.entries {
+		if name == oldName {
+			moved[newName] = entry
+		} else if strings.HasPrefix(name, prefix) {
+			moved[strings.TrimSuffix(newName, "/")+"/"+strings.TrimPrefix(name, prefix)] = entry
+		} else {
+			continue
+		}
+		delete(cache.entries, name)
+	}
+	for name, entry := range moved {
+		cache.entries[name] = entry
+	}
+}
@@ -2,34 +2,151 @@ package rwfs
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/lzw"
+	"compress/zlib"
+	"errors"
 	"io"
+	"sync"
 )
 
-// CompressData compresses the given data using gzip with the specified compression level
-func CompressData(data []byte, level int) ([]byte, error) {
+// Codec is a compression algorithm used for snapshots and for file contents
+// stored at rest. Codecs are looked up by name, which is recorded next to the
+// compressed data so that it can be read back with the same codec.
+type Codec interface {
+	// Name returns the name the codec is registered under
+	Name() string
+	// NewWriter returns a writer compressing to w. level is a compression
+	// level in the range of compress/flate; codecs without levels ignore it.
+	NewWriter(w io.Writer, level int) (io.WriteCloser, error)
+	// NewReader returns a reader decompressing from r
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// DefaultCodec is the name of the codec used when none is configured
+const DefaultCodec = "gzip"
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		"gzip":  gzipCodec{},
+		"zlib":  zlibCodec{},
+		"flate": flateCodec{},
+		"lzw":   lzwCodec{},
+	}
+)
+
+// RegisterCodec makes a codec available under its name. It fails if the name
+// is empty or already taken.
+func RegisterCodec(codec Codec) error {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	name := codec.Name()
+	if name == "" {
+		return errors.New("codec name is empty")
+	}
+	if _, exists := codecs[name]; exists {
+		return errors.New("codec already registered: " + name)
+	}
+	codecs[name] = codec
+	return nil
+}
+
+// LookupCodec returns the codec registered under name. An empty name selects
+// DefaultCodec.
+func LookupCodec(name string) (Codec, error) {
+	if name == "" {
+		name = DefaultCodec
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	codec, exists := codecs[name]
+	if !exists {
+		return nil, ErrUnknownCodec
+	}
+	return codec, nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zlibCodec struct{}
+
+func (zlibCodec) Name() string { return "zlib" }
+
+func (zlibCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return zlib.NewWriterLevel(w, level)
+}
+
+func (zlibCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+type flateCodec struct{}
+
+func (flateCodec) Name() string { return "flate" }
+
+func (flateCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return flate.NewWriter(w, level)
+}
+
+func (flateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+type lzwCodec struct{}
+
+func (lzwCodec) Name() string { return "lzw" }
+
+func (lzwCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return lzw.NewWriter(w, lzw.LSB, 8), nil
+}
+
+func (lzwCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return lzw.NewReader(r, lzw.LSB, 8), nil
+}
+
+// compressLevel returns the level to use for a configured compression level,
+// where zero selects the default level
+func compressLevel(level int) int {
+	if level == 0 {
+		return flate.DefaultCompression
+	}
+	return level
+}
+
+// compress compresses data as a whole with the given codec
+func compress(codec Codec, data []byte, level int) ([]byte, error) {
 	var buf bytes.Buffer
-	writer, err := gzip.NewWriterLevel(&buf, level)
+	writer, err := codec.NewWriter(&buf, level)
 	if err != nil {
 		return nil, err
 	}
-	defer writer.Close()
-
-	_, err = writer.Write(data)
-	if err != nil {
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
 		return nil, err
 	}
-
 	if err := writer.Close(); err != nil {
 		return nil, err
 	}
-
 	return buf.Bytes(), nil
 }
 
-// DecompressData decompresses the given gzip-compressed data
-func DecompressData(data []byte) ([]byte, error) {
-	reader, err := gzip.NewReader(bytes.NewReader(data))
+// decompress decompresses data compressed by compress
+func decompress(codec Codec, data []byte) ([]byte, error) {
+	reader, err := codec.NewReader(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
@@ -37,3 +154,13 @@ func DecompressData(data []byte) ([]byte, error) {
 
 	return io.ReadAll(reader)
 }
+
+// CompressData compresses the given data using gzip with the specified compression level
+func CompressData(data []byte, level int) ([]byte, error) {
+	return compress(gzipCodec{}, data, level)
+}
+
+// DecompressData decompresses the given gzip-compressed data
+func DecompressData(data []byte) ([]byte, error) {
+	return decompress(gzipCodec{}, data)
+}
@@ -0,0 +1,130 @@
+package rwfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testCodec is flate registered under another name
+type testCodec struct{}
+
+func (testCodec) Name() string { return "test" }
+
+func (testCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return flate.NewWriter(w, level)
+}
+
+func (testCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+// unnamedCodec is a codec without a name
+type unnamedCodec struct{ testCodec }
+
+func (unnamedCodec) Name() string { return "" }
+
+var registerTestCodec sync.Once
+
+// useTestCodec registers testCodec, once for all tests
+func useTestCodec(t *testing.T) {
+	t.Helper()
+	var err error
+	registerTestCodec.Do(func() { err = RegisterCodec(testCodec{}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCodecRegistry(t *testing.T) {
+	useTestCodec(t)
+	for _, name := range []string{"", "gzip", "zlib", "flate", "lzw", "test"} {
+		codec, err := LookupCodec(name)
+		if err != nil {
+			t.Errorf("LookupCodec(%q): %v", name, err)
+			continue
+		}
+		want := name
+		if want == "" {
+			want = DefaultCodec
+		}
+		if codec.Name() != want {
+			t.Errorf("LookupCodec(%q) = %s, want %s", name, codec.Name(), want)
+		}
+	}
+	if _, err := LookupCodec("zstd"); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("LookupCodec of an unregistered codec: error = %v, want ErrUnknownCodec", err)
+	}
+	if err := RegisterCodec(testCodec{}); err == nil {
+		t.Error("registering a name twice succeeded")
+	}
+	if err := RegisterCodec(unnamedCodec{}); err == nil {
+		t.Error("registering an empty name succeeded")
+	}
+}
+
+func TestWithCodec(t *testing.T) {
+	useTestCodec(t)
+	for _, encryption := range []bool{false, true} {
+		config := FileSystemConfig{
+			Filepath:      filepath.Join(t.TempDir(), "data.rwfs"),
+			Compression:   true,
+			Codec:         "lzw",
+			Encryption:    encryption,
+			EncryptionKey: "secret",
+			KeyIterations: 1000,
+		}
+		fs, err := NewLocalFileSystem(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents := bytes.Repeat([]byte("compress me "), 10000)
+		for name, opts := range map[string][]FileOption{
+			"/default.txt": nil,
+			"/test.txt":    {WithCodec("test", 9)},
+		} {
+			file, err := fs.CreateFile(name, "", ReadWrite, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := file.Write(contents); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := fs.CreateFile("/zstd.txt", "", ReadWrite, WithCodec("zstd", 0)); !errors.Is(err, ErrUnknownCodec) {
+			t.Errorf("WithCodec of an unregistered codec: error = %v, want ErrUnknownCodec", err)
+		}
+		if err := fs.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		reopened, err := NewLocalFileSystem(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range map[string]string{"default.txt": "lzw", "test.txt": "test"} {
+			if got := reopened.RootDir.Entries[name].data.codec.codec.Name(); got != want {
+				t.Errorf("%s is stored with %s, want %s", name, got, want)
+			}
+			if got := readFile(t, reopened, "/"+name); !bytes.Equal(got, contents) {
+				t.Errorf("%s differs after reloading", name)
+			}
+		}
+
+		// Files written with a codec that is no longer registered do not load
+		codecsMu.Lock()
+		delete(codecs, "test")
+		codecsMu.Unlock()
+		_, err = NewLocalFileSystem(config)
+		codecsMu.Lock()
+		codecs["test"] = testCodec{}
+		codecsMu.Unlock()
+		if !errors.Is(err, ErrUnknownCodec) {
+			t.Errorf("unregistered codec: error = %v, want ErrUnknownCodec", err)
+		}
+	}
+}
@@ -1,10 +1,62 @@
 package rwfs
 
+import "time"
+
 // FileSystemConfig holds the configuration options for initializing a LocalFileSystem
 type FileSystemConfig struct {
 	Filepath      string
 	Compression   bool
-	CompressLevel int
+	CompressLevel int // compression level, zero selects the default
 	Encryption    bool
 	EncryptionKey string
+
+	// EncryptionRawKey is a 32-byte key used as is instead of deriving one
+	// from the EncryptionKey passphrase
+	EncryptionRawKey []byte
+
+	// MigrateSnapshots allows loading snapshots written without encryption,
+	// or by versions that did not bind encrypted contents to their snapshot.
+	// Their contents are encrypted and bound on load and in the next save.
+	// Without it such snapshots fail to load, since anyone able to edit them
+	// could replace the tree unnoticed. Only enable it to migrate snapshots
+	// that are known to be genuine.
+	MigrateSnapshots bool
+
+	// KeyIterations is the number of PBKDF2-HMAC-SHA256 iterations used to
+	// derive the key from EncryptionKey. Zero selects a default of 600000,
+	// and at most 10000000 are allowed.
+	// The salt and count are stored in each snapshot, so changing it only
+	// affects new file systems.
+	KeyIterations int
+
+	// Codec is the name of the registered Codec used for snapshots and for
+	// file contents when Compression is set. Empty selects DefaultCodec.
+	Codec string
+
+	// BackupGenerations is the number of previous snapshots kept next to the
+	// snapshot file when it is saved, as name.1 (newest) to name.N (oldest)
+	BackupGenerations int
+
+	// Journal enables the write-ahead journal: every mutation is appended to
+	// Filepath + ".journal" and replayed over the snapshot on load
+	Journal bool
+
+	// JournalSync syncs the journal to disk after every record. Without it a
+	// crash of the machine, rather than of the process, may lose the records
+	// still held by the operating system.
+	JournalSync bool
+
+	// JournalCompactSize is the journal size in bytes at which it is compacted
+	// into a new snapshot in the background. Zero selects a default of 8 MiB
+	// and a negative value disables background compaction.
+	JournalCompactSize int64
+
+	// AutosaveInterval saves unsaved changes to Filepath in the background
+	// whenever the interval passes. Zero disables periodic autosaves.
+	AutosaveInterval time.Duration
+
+	// AutosaveBytes saves unsaved changes to Filepath in the background once
+	// this many bytes have been written since the last save. Zero disables
+	// size-triggered autosaves.
+	AutosaveBytes int64
 }
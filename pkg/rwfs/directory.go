@@ -3,6 +3,7 @@ package rwfs
 import (
 	"errors"
 	"os"
+	"sort"
 	"time"
 )
 
@@ -15,174 +16,230 @@ type DirEntry struct {
 
 // MemDirectory represents a directory in the memory file system
 type MemDirectory struct {
-	Name        string
-	mu          RWMutex
-	Entries     map[string]*MemFile
-	Dirs        map[string]*MemDirectory
-	modTime     time.Time
-	permissions DirPermission
+	Name    string
+	parent  *MemDirectory
+	mu      RWMutex
+	Entries map[string]*MemFile
+	Dirs    map[string]*MemDirectory
+	modTime time.Time
+	mode    os.FileMode
+	owner   string
+	group   string
 }
 
-// NewMemDirectory creates a new memory directory
-func NewMemDirectory(name string, permissions DirPermission) *MemDirectory {
+// NewMemDirectory creates a new memory directory with the given permission
+// bits
+func NewMemDirectory(name string, mode os.FileMode) *MemDirectory {
 	return &MemDirectory{
-		Name:        name,
-		Entries:     make(map[string]*MemFile),
-		Dirs:        make(map[string]*MemDirectory),
-		modTime:     time.Now(),
-		permissions: permissions,
+		Name:    name,
+		Entries: make(map[string]*MemFile),
+		Dirs:    make(map[string]*MemDirectory),
+		modTime: time.Now(),
+		mode:    mode & modeMask,
 	}
 }
 
-// CreateDir creates a new directory within the file system
+// CreateDir creates a new directory at the given path with mode 0777 less
+// the umask
 func (fs *MemFileSystem) CreateDir(name string) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	// Check if the current directory has write permissions
-	if !fs.CWD.permissions.Write {
-		return errors.New("write permission denied")
+	return fs.mkdir(name, Exec)
+}
+
+// mkdir creates a new directory with the permission bits perm less the umask;
+// the caller must hold the write lock
+func (fs *MemFileSystem) mkdir(name string, perm os.FileMode) error {
+	if err := fs.mutable(); err != nil {
+		return err
+	}
+	parent, base, err := fs.walkParent(name)
+	if err != nil {
+		return err
 	}
 
-	if _, exists := fs.CWD.Dirs[name]; exists {
-		return errors.New("directory already exists")
+	// Check if the parent directory has write permissions
+	if !parent.allows(permWrite) {
+		return errWriteDenied
 	}
 
-	newDir := NewMemDirectory(name, DirPermission{Read: true, Write: true, Execute: true})
-	// Add the new directory to the appropriate parent directory
-	if fs.CWD == fs.RootDir {
-		fs.RootDir.Dirs[name] = newDir
-	} else {
-		fs.CWD.Dirs[name] = newDir
+	if _, exists := parent.Dirs[base]; exists {
+		return os.ErrExist
+	}
+	if _, exists := parent.Entries[base]; exists {
+		return os.ErrExist
 	}
 
-	fs.CWD.modTime = time.Now()
+	mode := fs.createMode(perm)
+	newDir := NewMemDirectory(base, mode)
+	newDir.parent = parent
+	parent.Dirs[base] = newDir
+	parent.modTime = time.Now()
 
-	return nil
+	return fs.record(journalRecord{Op: journalMkdir, Path: fs.absPath(name), Mode: mode})
 }
 
-// RemoveDir removes a directory from the file system
+// RemoveDir removes the empty directory at the given path. Use RemoveAll to
+// remove a directory together with its contents.
 func (fs *MemFileSystem) RemoveDir(name string) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	// Check if the directory being removed is the current working directory of any user
-	for _, dir := range fs.CWD.Dirs {
-		if dir == fs.CWD {
-			return errors.New("cannot remove directory: current working directory")
-		}
+	if err := fs.mutable(); err != nil {
+		return err
 	}
 
-	// Check if the current directory has write permissions
-	if !fs.CWD.permissions.Write {
-		return errors.New("write permission denied")
+	parent, base, err := fs.walkParent(name)
+	if err != nil {
+		return err
 	}
 	// Check if the directory exists
-	if _, exists := fs.CWD.Dirs[name]; !exists {
-		return errors.New("directory does not exist. Try PWD and ChangeDir")
+	dir, exists := parent.Dirs[base]
+	if !exists {
+		if _, isFile := parent.Entries[base]; isFile {
+			return ErrNotDir
+		}
+		return os.ErrNotExist
+	}
+
+	// Check if the directory being removed is the current working directory or one of its ancestors
+	if fs.containsCWD(dir) {
+		return errors.New("cannot remove directory: current working directory")
+	}
+
+	// Check if the parent directory has write permissions
+	if !parent.allows(permWrite) {
+		return errWriteDenied
+	}
+	if len(dir.Entries) > 0 || len(dir.Dirs) > 0 {
+		return ErrDirNotEmpty
 	}
 	// Remove the directory
-	delete(fs.CWD.Dirs, name)
-	fs.CWD.modTime = time.Now()
+	delete(parent.Dirs, base)
+	dir.parent = nil
+	parent.modTime = time.Now()
 
-	return nil
+	return fs.record(journalRecord{Op: journalRemove, Path: fs.absPath(name)})
 }
 
-// ChangeDir changes the current working directory
+// ChangeDir changes the current working directory. The path may be absolute
+// or relative to the current working directory, and may contain "." and "..".
 func (fs *MemFileSystem) ChangeDir(name string) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-
-	var dir *MemDirectory
-	var exists bool
-
-	if name == "/" {
-		dir = fs.RootDir
-	} else {
-		dir, exists = fs.CWD.Dirs[name]
-		if !exists {
-			return errors.New("directory does not exist")
-		}
+	dir, err := fs.walkDir(name)
+	if err != nil {
+		return err
 	}
 
 	// Check if the target directory has execute permissions
-	if !dir.permissions.Execute {
-		return errors.New("execute permission denied")
+	if !dir.allows(permExecute) {
+		return errExecuteDenied
 	}
 
 	fs.CWD = dir
 	return nil
 }
 
-// CreateFile creates a new file in the current directory
-func (fs *MemFileSystem) CreateFile(name, owner string, permissions FilePermission) (File, error) {
+// CreateFile creates a new file at the given path and opens it for reading
+// and writing. It fails if the file already exists. The file gets the
+// permission bits perm less the umask. Options such as WithCodec override how
+// the contents of the file are stored.
+func (fs *MemFileSystem) CreateFile(name, owner string, perm os.FileMode, opts ...FileOption) (File, error) {
+	var options fileOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	// Check if the current directory has write permissions
-	if !fs.CWD.permissions.Write {
-		return nil, errors.New("write permission denied")
+	handle, err := fs.openFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, owner, perm, options)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
 	}
+	return handle, nil
+}
 
-	if _, exists := fs.CWD.Entries[name]; exists {
-		return nil, os.ErrExist
-	}
+// FileOption customizes a file created by CreateFile
+type FileOption func(*fileOptions)
+
+type fileOptions struct {
+	codec string
+	level int
+}
 
-	file := NewMemFile(name, owner, permissions)
-	fs.CWD.Entries[name] = file
-	fs.CWD.modTime = time.Now()
-	fs.Cache.Put(name, file, true)
-	return file, nil
+// WithCodec stores the contents of the new file compressed with the named
+// codec at the given level, independent of the file system configuration
+func WithCodec(name string, level int) FileOption {
+	return func(opts *fileOptions) {
+		opts.codec = name
+		opts.level = level
+	}
 }
 
-// OpenFile opens a file in the current directory
+// OpenFile opens the file at the given path for reading. Every call returns
+// a new handle with its own offset.
 func (fs *MemFileSystem) OpenFile(name string) (File, error) {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
-	if file, exists := fs.Cache.Get(name); exists {
-		file.closed = false
-		return file, nil
+
+	handle, err := fs.openRead(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
 	}
-	file, exists := fs.CWD.Entries[name]
+	return handle, nil
+}
+
+// openRead opens the file at the given path for reading. The caller must
+// hold the read lock.
+func (fs *MemFileSystem) openRead(name string) (*FileHandle, error) {
+	// Always walk the path, so that every directory on the way is checked
+	// for execute permission; the cache only tracks the access
+	parent, base, err := fs.walkParent(name)
+	if err != nil {
+		return nil, err
+	}
+	file, exists := parent.Entries[base]
 	if !exists {
 		return nil, os.ErrNotExist
 	}
+	fs.Cache.Get(fs.absPath(name))
 	// Check if the file has read permissions
-	if !file.permissions.Read {
-		return nil, errors.New("read permission denied")
+	if !file.allows(permRead) {
+		return nil, errReadDenied
 	}
 
-	file.closed = false
-	return file, nil
+	return newFileHandle(fs, file, name, os.O_RDONLY), nil
 }
 
-// RemoveFile removes a file from the current directory
+// RemoveFile removes the file at the given path
 func (fs *MemFileSystem) RemoveFile(name string) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	// Check if the current directory has write permissions
-	if !fs.CWD.permissions.Write {
-		return errors.New("write permission denied")
-	}
-	file, exists := fs.CWD.Entries[name]
-	if !exists {
-		return os.ErrNotExist
+	if err := fs.mutable(); err != nil {
+		return err
 	}
-	if file.refCount > 1 {
-		file.refCount--
-	} else {
-		delete(fs.CWD.Entries, name)
 
+	parent, base, err := fs.walkParent(name)
+	if err != nil {
+		return err
 	}
-	fs.CWD.modTime = time.Now()
 
-	// Remove from cache
-	fs.Cache.mu.Lock()
-	defer fs.Cache.mu.Unlock()
-	delete(fs.Cache.entries, name)
-	return nil
+	// Check if the parent directory has write permissions
+	if !parent.allows(permWrite) {
+		return errWriteDenied
+	}
+	if _, exists := parent.Entries[base]; !exists {
+		return os.ErrNotExist
+	}
+	abs := fs.absPath(name)
+	fs.removeEntry(parent, base, abs)
+	parent.modTime = time.Now()
+	return fs.record(journalRecord{Op: journalRemove, Path: abs})
 }
 
 func (fs *MemFileSystem) ListFiles() ([]string, error) {
@@ -221,26 +278,42 @@ func (fs *MemFileSystem) ListDirContents() ([]DirEntry, error) {
 
 // DirectoryContents represents the contents of a directory
 type DirectoryContents struct {
-    DirectoryName  string
-    Files          []string
-    Subdirectories []string
+	DirectoryName  string
+	Files          []string
+	Subdirectories []string
 }
 
-// GetDirectoryContents returns the contents of the directory in a structured format
+// GetDirectoryContents returns the contents of the directory in a structured
+// format, with names in lexical order
 func (dir *MemDirectory) GetDirectoryContents() DirectoryContents {
-    files := make([]string, 0, len(dir.Entries))
-    for fileName := range dir.Entries {
-        files = append(files, fileName)
-    }
-
-    subDirs := make([]string, 0, len(dir.Dirs))
-    for subDirName := range dir.Dirs {
-        subDirs = append(subDirs, subDirName)
-    }
-
-    return DirectoryContents{
-        DirectoryName:  dir.Name,
-        Files:          files,
-        Subdirectories: subDirs,
-    }
+	files := make([]string, 0, len(dir.Entries))
+	for fileName := range dir.Entries {
+		files = append(files, fileName)
+	}
+
+	subDirs := make([]string, 0, len(dir.Dirs))
+	for subDirName := range dir.Dirs {
+		subDirs = append(subDirs, subDirName)
+	}
+	sort.Strings(files)
+	sort.Strings(subDirs)
+
+	return DirectoryContents{
+		DirectoryName:  dir.Name,
+		Files:          files,
+		Subdirectories: subDirs,
+	}
+}
+
+// Stat returns information about the directory
+func (dir *MemDirectory) Stat() (os.FileInfo, error) {
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	return &MemFileInfo{
+		name:    dir.Name,
+		modTime: dir.modTime,
+		mode:    os.ModeDir | dir.mode,
+		owner:   dir.owner,
+		group:   dir.group,
+	}, nil
 }
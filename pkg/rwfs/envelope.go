@@ -0,0 +1,284 @@
+package rwfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Envelope encryption
+//
+// When Encryption is enabled every file gets its own random AES-256 data key.
+// The contents of the file are stored in blocks (see filedata.go) that are
+// sealed with AES-GCM under the data key, after compression if that is enabled
+// as well. The data key is wrapped, that is sealed with the master key derived
+// from EncryptionKey, and only the wrapped form is persisted. Plaintext is
+// never kept in memory beyond a single read or write, and a leaked data key
+// only exposes the one file it belongs to.
+//
+// Each block is sealed on its own with a random nonce, so any block can be
+// read or rewritten without touching the others. Unlike the snapshot stream
+// (see stream.go), blocks are rewritten in place, which rules out counter
+// nonces. Like STREAM, the block index and a flag marking the last block are
+// authenticated as additional data, so blocks cannot be reordered, and
+// removing blocks from the end makes the new last block fail to open. The
+// version of a block is authenticated with it as well; see filedata.go.
+//
+// When a snapshot is written, every encrypted file gets a tag sealed with its
+// data key over the random ID of the snapshot, the path and inode number the
+// file is saved under, and the size and block versions of its contents. The
+// tag is checked when the snapshot is loaded, so contents moved to another
+// file or replayed from another snapshot are rejected with an IntegrityError
+// instead of showing up in the wrong place.
+
+// dataKeySize is the size of a file data key
+const dataKeySize = 32
+
+// Seal formats of encrypted blocks
+const (
+	sealUnbound    = iota // sealed without additional data
+	sealPositional        // bound to the block index and the last block flag
+	sealVersioned         // bound to the block version as well
+	sealVersion    = sealVersioned
+)
+
+// snapshotIDSize is the size of the random ID of a snapshot
+const snapshotIDSize = 16
+
+// positionAAD returns the additional data binding a block to its index
+func positionAAD(index int, last bool) []byte {
+	aad := binary.BigEndian.AppendUint64(make([]byte, 0, 9), uint64(index))
+	if last {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+// versionAAD returns the additional data binding a block to its index and
+// version
+func versionAAD(index int, version uint64, last bool) []byte {
+	aad := binary.BigEndian.AppendUint64(make([]byte, 0, 17), version)
+	return append(aad, positionAAD(index, last)...)
+}
+
+// bindingAAD returns the identity a file is bound to in the snapshot with the
+// given ID
+func bindingAAD(id []byte, path string, ino uint64, data *fileData) []byte {
+	aad := make([]byte, 0, len(id)+32+8*len(data.versions)+len(path))
+	aad = append(aad, id...)
+	aad = binary.BigEndian.AppendUint64(aad, ino)
+	aad = binary.BigEndian.AppendUint64(aad, uint64(data.size))
+	aad = binary.BigEndian.AppendUint64(aad, data.version)
+	aad = binary.BigEndian.AppendUint64(aad, uint64(len(data.versions)))
+	for _, version := range data.versions {
+		aad = binary.BigEndian.AppendUint64(aad, version)
+	}
+	return append(aad, path...)
+}
+
+// bindFile prepares file to be saved at path in the snapshot with the given
+// ID. Versioned contents are copied, so they cannot change while they are
+// encoded, and the tag binding them to the snapshot is returned with the copy.
+// Other files are returned as they are.
+func bindFile(id []byte, path string, file *MemFile) (*MemFile, []byte, error) {
+	file.mu.RLock()
+	versioned := file.data.versioned()
+	file.mu.RUnlock()
+	if !versioned {
+		return file, nil, nil
+	}
+	file, err := file.clone()
+	if err != nil {
+		return nil, nil, err
+	}
+	tag, err := sealBlock(file.data.codec.aead, nil, bindingAAD(id, path, file.ino, &file.data))
+	return file, tag, err
+}
+
+// check verifies the tag bindFile returned for a file of the tree when the
+// snapshot was written
+func (b *treeBinding) check(file *MemFile) error {
+	saved, exists := b.files[file]
+	if !exists {
+		return &IntegrityError{Path: file.Name}
+	}
+	if b.id == nil || saved.tag == nil {
+		return &IntegrityError{Path: saved.path}
+	}
+	aad := bindingAAD(b.id, saved.path, file.ino, &file.data)
+	if _, err := openBlock(file.data.codec.aead, saved.tag, aad); err != nil {
+		return &IntegrityError{Path: saved.path}
+	}
+	return nil
+}
+
+// newDataKey creates a random data key and returns the cipher for it together
+// with the key wrapped by masterKey
+func newDataKey(masterKey []byte) (cipher.AEAD, []byte, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := sealData(key, masterKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, wrapped, nil
+}
+
+// unwrapDataKey returns a data key wrapped by newDataKey
+func unwrapDataKey(wrapped, masterKey []byte) ([]byte, error) {
+	key, err := openData(wrapped, masterKey)
+	if err != nil || len(key) != dataKeySize {
+		return nil, ErrDecryptFailed
+	}
+	return key, nil
+}
+
+// newAEAD returns an AES-GCM cipher for key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealBlock encrypts a block, authenticating aad with it, and prepends the
+// random nonce
+func sealBlock(aead cipher.AEAD, plain, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, aad), nil
+}
+
+// openBlock decrypts a block sealed by sealBlock
+func openBlock(aead cipher.AEAD, stored, aad []byte) ([]byte, error) {
+	if len(stored) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := stored[:aead.NonceSize()], stored[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return plain, nil
+}
+
+// unsealTree prepares the files of a decoded tree for use. Wrapped data keys
+// are unwrapped with key, the master key the tree was saved with, and wrapped
+// again with the master key of the file system if that differs.
+//
+// binding holds the tags of an encrypted snapshot in the current format, in
+// which every file must be versioned and carry a valid tag. It is nil for
+// snapshots that are not encrypted or predate tags. Their contents are only
+// upgraded to the current seal format, or encrypted if the file system is,
+// with FileSystemConfig.MigrateSnapshots.
+func (fs *MemFileSystem) unsealTree(root *MemDirectory, key *masterKey, binding *treeBinding) error {
+	if key == nil {
+		key = fs.key
+	}
+	var err error
+	forEachFile(root, func(file *MemFile) {
+		codec := file.data.codec
+		switch {
+		case err != nil:
+		case codec != nil && codec.aead != nil:
+			// Already visited through another hard link
+		case codec != nil && codec.wrapped != nil:
+			if err = fs.unsealFile(codec, key); err != nil {
+				return
+			}
+			switch {
+			case binding != nil && codec.seal >= sealVersion:
+				if err = binding.check(file); err == nil {
+					err = file.data.verify()
+				}
+			case binding != nil || codec.seal >= sealVersion:
+				err = &IntegrityError{Path: file.Name}
+			case !fs.Config.MigrateSnapshots:
+				err = ErrUnboundSnapshot
+			default:
+				err = upgradeSeal(file)
+			}
+		case fs.Config.Encryption:
+			switch {
+			case binding != nil:
+				err = &IntegrityError{Path: file.Name}
+			case !fs.Config.MigrateSnapshots:
+				err = ErrUnboundSnapshot
+			default:
+				err = fs.encryptFile(file)
+			}
+		}
+	})
+	return err
+}
+
+// unsealFile unwraps the data key of a file with key and wraps it again with
+// the master key of the file system
+func (fs *MemFileSystem) unsealFile(codec *blockCodec, key *masterKey) error {
+	if key == nil {
+		return ErrKeyRequired
+	}
+	dataKey, err := unwrapDataKey(codec.wrapped, key.key)
+	if err != nil {
+		return err
+	}
+	if fs.key != nil && !bytes.Equal(fs.key.key, key.key) {
+		if codec.wrapped, err = sealData(dataKey, fs.key.key); err != nil {
+			return err
+		}
+	}
+	codec.aead, err = newAEAD(dataKey)
+	return err
+}
+
+// upgradeSeal stores contents sealed in an older format again in the current
+// one, keeping the data key
+func upgradeSeal(file *MemFile) error {
+	contents, err := file.data.bytes()
+	if err != nil {
+		return err
+	}
+	file.data.codec.seal = sealVersion
+	data := newFileData(file.data.codec)
+	if _, err := data.writeAt(contents, 0); err != nil {
+		return err
+	}
+	file.data = data
+	return nil
+}
+
+// encryptFile stores the contents of a file under a fresh data key, keeping
+// its compression codec
+func (fs *MemFileSystem) encryptFile(file *MemFile) error {
+	name, level := "", 0
+	if old := file.data.codec; old != nil && old.codec != nil {
+		name, level = old.codec.Name(), old.level
+	}
+	codec, err := fs.newBlockCodec(name, level)
+	if err != nil {
+		return err
+	}
+	contents, err := file.data.bytes()
+	if err != nil {
+		return err
+	}
+	data := newFileData(codec)
+	if _, err := data.writeAt(contents, 0); err != nil {
+		return err
+	}
+	file.data = data
+	return nil
+}
@@ -1,10 +1,97 @@
 package rwfs
 
-import "errors"
+import (
+	"errors"
+	"os"
+)
 
 // Define custom error types here if needed
 var (
-	ErrFileNotFound     = errors.New("file not found")
-	ErrFileAlreadyExist = errors.New("file already exists")
-	ErrPermissionDenied = errors.New("permission denied")
+	ErrFileNotFound      = errors.New("file not found")
+	ErrFileAlreadyExist  = errors.New("file already exists")
+	ErrPermissionDenied  = errors.New("permission denied")
+	ErrNotDir            = errors.New("not a directory")
+	ErrDirNotEmpty       = errors.New("directory not empty")
+	ErrSnapshotCorrupt   = errors.New("snapshot file is truncated or corrupt")
+	ErrSnapshotChecksum  = errors.New("snapshot checksum mismatch")
+	ErrSnapshotVersion   = errors.New("unsupported snapshot version")
+	ErrKeyRequired       = errors.New("snapshot is encrypted but no encryption key is configured")
+	ErrDecryptFailed     = errors.New("decryption failed: wrong key or tampered data")
+	ErrUnknownCodec      = errors.New("unknown compression codec")
+	ErrMasterKeyRequired = errors.New("encryption is enabled but no encryption key is configured")
+	ErrInvalidKey        = errors.New("raw encryption key must be 32 bytes")
+	ErrKeyIterations     = errors.New("key iterations must not exceed 10000000")
+	ErrWrongKey          = errors.New("old encryption key does not match the current key")
+	ErrNotEncrypted      = errors.New("snapshot is not encrypted but encryption is enabled; set MigrateSnapshots to load it")
+	ErrUnboundSnapshot   = errors.New("snapshot contents are not bound to it; set MigrateSnapshots to load it")
 )
+
+// Permission failures name the permission that is missing
+var (
+	errReadDenied    = permissionError("read")
+	errWriteDenied   = permissionError("write")
+	errExecuteDenied = permissionError("execute")
+)
+
+// permissionError reports that the read, write or execute permission is
+// missing. It matches os.ErrPermission, and so fs.ErrPermission, as well as
+// ErrPermissionDenied with errors.Is.
+type permissionError string
+
+func (e permissionError) Error() string {
+	return string(e) + " permission denied"
+}
+
+func (e permissionError) Is(target error) bool {
+	return target == os.ErrPermission || target == ErrPermissionDenied
+}
+
+// KeyMismatchError reports that a snapshot is encrypted with another key than
+// the configured one. KeyID identifies the key the snapshot expects, as
+// reported by LocalFileSystem.KeyID when it was written. It matches
+// ErrDecryptFailed with errors.Is.
+type KeyMismatchError struct {
+	KeyID string
+}
+
+func (e *KeyMismatchError) Error() string {
+	return "snapshot is encrypted with key " + e.KeyID + ", not with the configured key"
+}
+
+func (e *KeyMismatchError) Is(target error) bool {
+	return target == ErrDecryptFailed
+}
+
+// IntegrityError reports that the encrypted contents of a file in a snapshot
+// are not bound to it: they were moved from another file or replayed from
+// another snapshot. Path is where the file was saved. It matches
+// ErrDecryptFailed with errors.Is.
+type IntegrityError struct {
+	Path string
+}
+
+func (e *IntegrityError) Error() string {
+	return "integrity check failed: encrypted contents of " + e.Path + " do not belong to this file or snapshot"
+}
+
+func (e *IntegrityError) Is(target error) bool {
+	return target == ErrDecryptFailed
+}
+
+// payloadError reports that the payload of a snapshot could not be
+// decompressed or decoded. It matches ErrSnapshotCorrupt with errors.Is.
+type payloadError struct {
+	err error
+}
+
+func (e *payloadError) Error() string {
+	return "corrupt snapshot payload: " + e.err.Error()
+}
+
+func (e *payloadError) Unwrap() error {
+	return e.err
+}
+
+func (e *payloadError) Is(target error) bool {
+	return target == ErrSnapshotCorrupt
+}
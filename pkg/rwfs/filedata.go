@@ -0,0 +1,545 @@
+package rwfs
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"sync"
+	"sync/atomic"
+)
+
+// blockSize is the amount of file content that is compressed and encrypted as
+// a unit
+const blockSize = 64 << 10
+
+// fileData holds the contents of a file. Plain files keep them in a single
+// slice. Compressed or encrypted files split them into blocks of blockSize
+// bytes that are encoded independently, so reads and writes only decode the
+// blocks they touch. An empty block, or the part of a block beyond its stored
+// length, reads as zeros.
+//
+// Encrypted blocks are bound to their index and the last block is marked as
+// such (see envelope.go). Every block up to the end of the contents is stored,
+// holes as sealed empty blocks, and the last block ends exactly at the size of
+// the contents, so blocks cannot be reordered, dropped or cut off unnoticed.
+// Blocks sealed in the current format are bound to a version as well, which
+// is taken from a counter that increases with every block stored, so an older
+// copy of a block does not open in place of the current one.
+//
+// The block written last of compressed contents is kept in plain form and
+// only encoded once it fills, another block is written, or the contents are
+// cloned, encoded or truncated, so that small sequential writes do not
+// compress the same block over and over. Its stored form is stale until then.
+// Encrypted blocks are sealed before every write returns, so that no
+// plaintext stays in memory.
+//
+// Plain contents are shared with clones until they are modified, see clone.
+//
+// fileData is not safe for concurrent use; it is guarded by the lock of the
+// owning MemFile. Concurrent readers holding the read lock are fine.
+type fileData struct {
+	plain        []byte
+	share        *plainShare // sharing of plain with clones, nil if it is private
+	blocks       [][]byte
+	versions     []uint64 // version of every block of versioned contents
+	version      uint64   // version of the block stored last
+	size         int64
+	codec        *blockCodec
+	cache        *blockCache
+	pending      []byte // plain form of block pendingIndex if not nil, see flush
+	pendingIndex int
+}
+
+// plainShare counts the clones sharing a plain buffer. It belongs to the
+// buffer rather than to any of the files using it, so a clone released after
+// the buffer was replaced does not affect the sharing of the new one.
+type plainShare struct {
+	clones int32 // updated atomically
+}
+
+// blockCodec converts blocks between their plain and stored forms. Blocks
+// are compressed with codec unless it is nil, and then sealed with the data
+// key of the file unless aead is nil; see envelope.go.
+type blockCodec struct {
+	codec   Codec
+	level   int
+	aead    cipher.AEAD
+	wrapped []byte // data key wrapped with the master key
+	seal    int    // seal format of encrypted blocks
+}
+
+func (c *blockCodec) encode(plain, aad []byte) ([]byte, error) {
+	stored := plain
+	if c.codec != nil {
+		var err error
+		if stored, err = compress(c.codec, stored, c.level); err != nil {
+			return nil, err
+		}
+	}
+	if c.aead != nil {
+		return sealBlock(c.aead, stored, aad)
+	}
+	return stored, nil
+}
+
+func (c *blockCodec) decode(stored, aad []byte) ([]byte, error) {
+	plain := stored
+	if c.aead != nil {
+		var err error
+		if plain, err = openBlock(c.aead, plain, aad); err != nil {
+			return nil, err
+		}
+	}
+	if c.codec != nil {
+		return decompress(c.codec, plain)
+	}
+	return plain, nil
+}
+
+// encrypted reports whether blocks are sealed with a data key
+func (c *blockCodec) encrypted() bool {
+	return c.wrapped != nil
+}
+
+// blockCache keeps the most recently read block in its plain form, so that
+// sequential reads with small buffers decode every block only once
+type blockCache struct {
+	mu    sync.Mutex
+	index int
+	plain []byte
+}
+
+// newFileData returns empty contents stored with codec, or in a single plain
+// slice if codec is nil. Encrypted contents are never cached in plain form.
+func newFileData(codec *blockCodec) fileData {
+	data := fileData{codec: codec}
+	if codec != nil && !codec.encrypted() {
+		data.cache = &blockCache{index: -1}
+	}
+	return data
+}
+
+// len returns the logical size of the contents
+func (d *fileData) len() int64 {
+	if d.codec == nil {
+		return int64(len(d.plain))
+	}
+	return d.size
+}
+
+// storedLen returns the number of bytes used to store the contents. The
+// pending block counts with its plain size, since it is not encoded yet.
+func (d *fileData) storedLen() int64 {
+	if d.codec == nil {
+		return int64(len(d.plain))
+	}
+	var n int64
+	for index, block := range d.blocks {
+		if d.pending != nil && index == d.pendingIndex {
+			n += int64(len(d.pending))
+		} else {
+			n += int64(len(block))
+		}
+	}
+	return n
+}
+
+// readAt copies the contents starting at off into p and returns the number of
+// bytes copied, which is less than len(p) at the end of the contents
+func (d *fileData) readAt(p []byte, off int64) (int, error) {
+	if d.codec == nil {
+		if off >= int64(len(d.plain)) {
+			return 0, nil
+		}
+		return copy(p, d.plain[off:]), nil
+	}
+
+	if end := d.size - off; end < int64(len(p)) {
+		if end <= 0 {
+			return 0, nil
+		}
+		p = p[:end]
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		index, start := int(pos/blockSize), int(pos%blockSize)
+		plain, err := d.block(index)
+		if err != nil {
+			return n, err
+		}
+		chunk := p[n:min(len(p), n+blockSize-start)]
+		copied := 0
+		if start < len(plain) {
+			copied = copy(chunk, plain[start:])
+		}
+		clear(chunk[copied:])
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// bound reports whether blocks are sealed bound to their position
+func (d *fileData) bound() bool {
+	return d.codec != nil && d.codec.aead != nil && d.codec.seal >= sealPositional
+}
+
+// versioned reports whether blocks are sealed bound to their version
+func (d *fileData) versioned() bool {
+	return d.bound() && d.codec.seal >= sealVersioned
+}
+
+// aad returns the additional data a block is sealed with
+func (d *fileData) aad(index int) []byte {
+	switch {
+	case d.versioned():
+		return versionAAD(index, d.versions[index], index == len(d.blocks)-1)
+	case d.bound():
+		return positionAAD(index, index == len(d.blocks)-1)
+	}
+	return nil
+}
+
+// block returns the plain form of a block, which may be shorter than
+// blockSize; the result must not be modified
+func (d *fileData) block(index int) ([]byte, error) {
+	if d.pending != nil && index == d.pendingIndex {
+		return d.pending, nil
+	}
+	if index >= len(d.blocks) || len(d.blocks[index]) == 0 {
+		if d.bound() {
+			// Sealed contents have no holes, so the block was removed
+			return nil, ErrDecryptFailed
+		}
+		return nil, nil
+	}
+	if d.cache == nil {
+		return d.codec.decode(d.blocks[index], d.aad(index))
+	}
+	d.cache.mu.Lock()
+	defer d.cache.mu.Unlock()
+	if d.cache.index == index {
+		return d.cache.plain, nil
+	}
+	plain, err := d.codec.decode(d.blocks[index], d.aad(index))
+	if err != nil {
+		return nil, err
+	}
+	d.cache.index, d.cache.plain = index, plain
+	return plain, nil
+}
+
+// writeAt writes p at offset off, growing the contents as needed
+func (d *fileData) writeAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	if d.codec == nil {
+		d.own()
+		if end > int64(len(d.plain)) {
+			d.resize(end)
+		}
+		return copy(d.plain[off:], p), nil
+	}
+
+	defer d.invalidate()
+	if end > d.size {
+		if err := d.extend(blockCount(end)); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		index, start := int(pos/blockSize), int(pos%blockSize)
+		chunk := p[n:min(len(p), n+blockSize-start)]
+		if err := d.writeBlock(index, start, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	if end > d.size {
+		d.size = end
+	}
+	return n, nil
+}
+
+// writeBlock writes chunk at offset start of a block. Partial writes go to
+// the pending block, which is encoded once a write reaches the end of the
+// block, and right away if it is encrypted.
+func (d *fileData) writeBlock(index, start int, chunk []byte) error {
+	if d.pending != nil && d.pendingIndex != index {
+		if err := d.flush(); err != nil {
+			return err
+		}
+	}
+	if d.pending == nil {
+		if start == 0 && len(chunk) == blockSize {
+			// Whole block, the old content does not matter
+			return d.store(index, bytes.Clone(chunk))
+		}
+		old, err := d.block(index)
+		if err != nil {
+			return err
+		}
+		d.pending = make([]byte, len(old), blockSize)
+		d.pendingIndex = index
+		copy(d.pending, old)
+	}
+	if end := start + len(chunk); end > len(d.pending) {
+		// The pending block never shrinks, so the space it grows into is zero
+		d.pending = d.pending[:end]
+	}
+	copy(d.pending[start:], chunk)
+	if start+len(chunk) == blockSize || d.codec.encrypted() {
+		return d.flush()
+	}
+	return nil
+}
+
+// flush encodes and stores the pending block, if any
+func (d *fileData) flush() error {
+	if d.pending == nil {
+		return nil
+	}
+	return d.store(d.pendingIndex, d.pending)
+}
+
+// store encodes a block and stores it at index, replacing the pending block
+// if it is the one at index
+func (d *fileData) store(index int, plain []byte) error {
+	if err := d.extend(index + 1); err != nil {
+		return err
+	}
+	if d.versioned() {
+		d.version++
+		d.versions[index] = d.version
+	}
+	stored, err := d.codec.encode(plain, d.aad(index))
+	if err != nil {
+		return err
+	}
+	d.blocks[index] = stored
+	if d.pending != nil && index == d.pendingIndex {
+		d.pending = nil
+	}
+	return nil
+}
+
+// extend grows the list of blocks to count entries. New blocks are holes. In
+// sealed contents they are stored as sealed empty blocks, and the previous
+// last block is sealed again since it is no longer the last one.
+func (d *fileData) extend(count int) error {
+	old := len(d.blocks)
+	if count <= old {
+		return nil
+	}
+	if !d.bound() {
+		d.blocks = append(d.blocks, make([][]byte, count-old)...)
+		return nil
+	}
+
+	var last []byte
+	if old > 0 {
+		var err error
+		if last, err = d.block(old - 1); err != nil {
+			return err
+		}
+	}
+	d.blocks = append(d.blocks, make([][]byte, count-old)...)
+	if d.versioned() {
+		d.versions = append(d.versions, make([]uint64, count-old)...)
+	}
+	if old > 0 {
+		if err := d.store(old-1, last); err != nil {
+			return err
+		}
+	}
+	for index := old; index < count; index++ {
+		if err := d.store(index, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockCount returns the number of blocks holding size bytes
+func blockCount(size int64) int {
+	return int((size + blockSize - 1) / blockSize)
+}
+
+// truncate changes the logical size of the contents. Extending them fills the
+// new space with zeros.
+func (d *fileData) truncate(size int64) error {
+	if d.codec == nil {
+		d.own()
+		d.resize(size)
+		return nil
+	}
+
+	defer d.invalidate()
+	if err := d.flush(); err != nil {
+		return err
+	}
+	if d.bound() {
+		return d.truncateSealed(size)
+	}
+	if size < d.size {
+		count := blockCount(size)
+		if count < len(d.blocks) {
+			clear(d.blocks[count:])
+			d.blocks = d.blocks[:count]
+		}
+		// Cut the stale tail of the last block so that it reads as zeros if
+		// the contents grow again
+		if keep := int(size % blockSize); keep != 0 && count == len(d.blocks) {
+			plain, err := d.block(count - 1)
+			if err != nil {
+				return err
+			}
+			if len(plain) > keep {
+				if err := d.store(count-1, plain[:keep]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	d.size = size
+	return nil
+}
+
+// truncateSealed implements truncate for sealed contents, whose last block
+// has to end exactly at the new size
+func (d *fileData) truncateSealed(size int64) error {
+	count := blockCount(size)
+	if count == 0 {
+		d.blocks, d.versions, d.size = nil, nil, 0
+		return nil
+	}
+	var old []byte
+	if count <= len(d.blocks) {
+		var err error
+		if old, err = d.block(count - 1); err != nil {
+			return err
+		}
+		clear(d.blocks[count:])
+		d.blocks = d.blocks[:count]
+		if d.versioned() {
+			d.versions = d.versions[:count]
+		}
+	}
+	plain := make([]byte, size-int64(count-1)*blockSize)
+	copy(plain, old)
+	if err := d.store(count-1, plain); err != nil {
+		return err
+	}
+	d.size = size
+	return nil
+}
+
+// verify checks that sealed contents are complete: every block is present
+// and the last one ends at the size of the contents
+func (d *fileData) verify() error {
+	if !d.bound() {
+		return nil
+	}
+	count := blockCount(d.size)
+	if count != len(d.blocks) || (d.versioned() && count != len(d.versions)) {
+		return ErrDecryptFailed
+	}
+	if count == 0 {
+		return nil
+	}
+	plain, err := d.block(count - 1)
+	if err != nil {
+		return err
+	}
+	if int64(len(plain)) != d.size-int64(count-1)*blockSize {
+		return ErrDecryptFailed
+	}
+	return nil
+}
+
+// resize grows or shrinks plain contents to size bytes
+func (d *fileData) resize(size int64) {
+	if size <= int64(cap(d.plain)) {
+		old := len(d.plain)
+		d.plain = d.plain[:size]
+		if int(size) > old {
+			clear(d.plain[old:])
+		}
+		return
+	}
+	grown := make([]byte, size, size+size/4)
+	copy(grown, d.plain)
+	d.plain = grown
+}
+
+// invalidate drops the cached block after the contents changed
+func (d *fileData) invalidate() {
+	if d.cache == nil {
+		return
+	}
+	d.cache.mu.Lock()
+	d.cache.index, d.cache.plain = -1, nil
+	d.cache.mu.Unlock()
+}
+
+// own gives plain contents that are shared with a clone a private copy before
+// they are modified
+func (d *fileData) own() {
+	if d.share == nil {
+		return
+	}
+	if atomic.LoadInt32(&d.share.clones) > 0 {
+		d.plain = bytes.Clone(d.plain)
+	}
+	d.share = nil
+}
+
+// release ends sharing plain contents with c, a clone that is no longer used.
+// Only the buffer c was cloned from is affected, whether or not d still uses
+// it. It only needs the read lock.
+func (d *fileData) release(c *fileData) {
+	if c.share != nil {
+		atomic.AddInt32(&c.share.clones, -1)
+		c.share = nil
+	}
+}
+
+// bytes returns a copy of the whole contents
+func (d *fileData) bytes() ([]byte, error) {
+	if d.codec == nil {
+		return bytes.Clone(d.plain), nil
+	}
+	buf := make([]byte, d.size)
+	_, err := d.readAt(buf, 0)
+	return buf, err
+}
+
+// clone returns an independent copy of the contents. Stored blocks are never
+// modified in place, so they are shared with the copy. Plain contents are
+// shared as well until the next write copies them, so that snapshots do not
+// double the memory held by large files; the copy must not be modified, and
+// release ends the sharing once it is no longer used. The codec is copied, so
+// the copy keeps the wrapped data key it was made with when the master key is
+// rotated. The pending block has to be flushed first. clone needs the write
+// lock, since it may start tracking the sharing of plain contents.
+func (d *fileData) clone() fileData {
+	c := fileData{size: d.size, version: d.version, codec: d.codec}
+	if d.codec != nil {
+		codec := *d.codec
+		c.codec = &codec
+	}
+	if d.codec == nil {
+		if d.share == nil {
+			d.share = &plainShare{}
+		}
+		atomic.AddInt32(&d.share.clones, 1)
+		c.plain, c.share = d.plain, d.share
+		return c
+	}
+	c.blocks = append([][]byte(nil), d.blocks...)
+	c.versions = append([]uint64(nil), d.versions...)
+	if d.cache != nil {
+		c.cache = &blockCache{index: -1}
+	}
+	return c
+}
@@ -0,0 +1,283 @@
+package rwfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// boundaryOffset returns a random offset close to one of the first few block
+// boundaries
+func boundaryOffset(rng *rand.Rand) int64 {
+	return int64(max(0, rng.Intn(4)*blockSize+rng.Intn(9)-4))
+}
+
+// checkContents compares the whole file and a random range of it to want
+func checkContents(t *testing.T, file *FileHandle, want []byte, rng *rand.Rand) {
+	t.Helper()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(want)) {
+		t.Fatalf("size = %d, want %d", info.Size(), len(want))
+	}
+	got := make([]byte, len(want))
+	if _, err := file.ReadAt(got, 0); err != nil && len(want) > 0 {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("contents differ")
+	}
+	if len(want) == 0 {
+		return
+	}
+	off := rng.Intn(len(want))
+	part := make([]byte, rng.Intn(2*blockSize)+1)
+	n, _ := file.ReadAt(part, int64(off))
+	if !bytes.Equal(part[:n], want[off:off+n]) || n != min(len(part), len(want)-off) {
+		t.Fatalf("ReadAt(%d, %d) differs", len(part), off)
+	}
+}
+
+func TestFileDataRandomAccess(t *testing.T) {
+	for _, test := range testConfigs {
+		t.Run(test.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			fs, err := NewLocalFileSystem(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fs.CreateFile("/data.bin", "", ReadWrite); err != nil {
+				t.Fatal(err)
+			}
+			handle, err := fs.OpenFileFlags("/data.bin", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := handle.(*FileHandle)
+
+			var want []byte
+			for i := 0; i < 200; i++ {
+				off := boundaryOffset(rng)
+				if rng.Intn(4) == 0 {
+					if err := file.Truncate(off); err != nil {
+						t.Fatal(err)
+					}
+					if int(off) <= len(want) {
+						want = want[:off]
+					} else {
+						want = append(want, make([]byte, int(off)-len(want))...)
+					}
+				} else {
+					p := pattern(rng.Intn(blockSize+20), byte(i))
+					if _, err := file.WriteAt(p, off); err != nil {
+						t.Fatal(err)
+					}
+					if end := int(off) + len(p); end > len(want) {
+						want = append(want, make([]byte, end-len(want))...)
+					}
+					copy(want[off:], p)
+				}
+				checkContents(t, file, want, rng)
+			}
+
+			var buf bytes.Buffer
+			if err := fs.SaveTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := NewLocalFileSystem(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := loaded.LoadFrom(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := readFile(t, loaded, "/data.bin"); !bytes.Equal(got, want) {
+				t.Errorf("loaded contents differ: %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestFileDataSealedBlocks(t *testing.T) {
+	// sealed returns the contents of a file of three blocks
+	sealed := func() *fileData {
+		fs := NewMemFileSystem(FileSystemConfig{Encryption: true, EncryptionKey: "secret", KeyIterations: 1000})
+		file, err := fs.CreateFile("/a", "", ReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write(pattern(2*blockSize+10, 1)); err != nil {
+			t.Fatal(err)
+		}
+		c, err := fs.RootDir.Entries["a"].clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &c.data
+	}
+	read := func(d *fileData) error {
+		_, err := d.bytes()
+		return err
+	}
+
+	if d := sealed(); read(d) != nil || d.verify() != nil {
+		t.Fatal("untouched contents do not open")
+	}
+
+	d := sealed()
+	d.blocks[0], d.blocks[1] = d.blocks[1], d.blocks[0]
+	d.versions[0], d.versions[1] = d.versions[1], d.versions[0]
+	if err := read(d); !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("blocks swapped: error = %v, want ErrDecryptFailed", err)
+	}
+
+	d = sealed()
+	d.blocks, d.versions, d.size = d.blocks[:2], d.versions[:2], 2*blockSize
+	if err := d.verify(); !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("last block dropped: error = %v, want ErrDecryptFailed", err)
+	}
+
+	d = sealed()
+	d.size--
+	if err := d.verify(); !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("size cut: error = %v, want ErrDecryptFailed", err)
+	}
+}
+
+func TestFileDataCloneIsIndependent(t *testing.T) {
+	fs := NewMemFileSystem(FileSystemConfig{})
+	file, err := fs.CreateFile("/a", "", ReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	original := fs.RootDir.Entries["a"]
+	c, err := original.clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := original.WriteAt([]byte("after!"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(c.Bytes()); got != "before" {
+		t.Errorf("clone = %q after writing the original, want %q", got, "before")
+	}
+	original.release(c)
+	if got := string(original.Bytes()); got != "after!" {
+		t.Errorf("original = %q, want %q", got, "after!")
+	}
+}
+
+func TestFileDataReleaseStaleClone(t *testing.T) {
+	fs := NewMemFileSystem(FileSystemConfig{})
+	if _, err := fs.CreateFile("/a", "", ReadWrite); err != nil {
+		t.Fatal(err)
+	}
+	original := fs.RootDir.Entries["a"]
+	empty, err := original.clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := original.WriteAt([]byte("abc"), 0); err != nil {
+		t.Fatal(err)
+	}
+	c, err := original.clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Releasing the clone of the empty contents must not end the sharing
+	// with the later clone
+	original.release(empty)
+	if _, err := original.WriteAt([]byte("XYZ"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(c.Bytes()); got != "abc" {
+		t.Errorf("clone = %q after writing the original, want %q", got, "abc")
+	}
+	original.release(c)
+}
+
+func TestFileDataStatPending(t *testing.T) {
+	fs := NewMemFileSystem(FileSystemConfig{Compression: true})
+	file, err := fs.CreateFile("/a", "", ReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Stat("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.(*MemFileInfo).StoredSize(); got != 5 {
+		t.Errorf("StoredSize = %d with the block pending, want 5", got)
+	}
+	if fs.RootDir.Entries["a"].data.pending == nil {
+		t.Error("Stat encoded the pending block")
+	}
+}
+
+func TestFileDataSmallWrites(t *testing.T) {
+	for _, test := range testConfigs {
+		t.Run(test.name, func(t *testing.T) {
+			fs, err := NewLocalFileSystem(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file, err := fs.CreateFile("/log.txt", "", ReadWrite)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []byte
+			for i := 0; len(want) < 3*blockSize+100; i++ {
+				line := fmt.Sprintf("%08d %s\n", i, bytes.Repeat([]byte{'x'}, 90))
+				if _, err := fmt.Fprint(file, line); err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, line...)
+				if i%500 == 0 {
+					// Touch an earlier block, and read back the pending one
+					if _, err := file.(*FileHandle).WriteAt([]byte("rewritten"), 10); err != nil {
+						t.Fatal(err)
+					}
+					copy(want[10:], "rewritten")
+					got := make([]byte, 100)
+					n, _ := file.(*FileHandle).ReadAt(got, int64(len(want)-50))
+					if !bytes.Equal(got[:n], want[len(want)-50:]) {
+						t.Fatalf("ReadAt of the last line differs after %d lines", i)
+					}
+				}
+			}
+
+			data := &fs.RootDir.Entries["log.txt"].data
+			if encrypted := data.codec != nil && data.codec.encrypted(); encrypted && data.pending != nil {
+				t.Error("plaintext of an encrypted block kept after the write returned")
+			} else if !encrypted && data.codec != nil && data.pending == nil {
+				t.Error("the block written last was compressed by a partial write")
+			}
+			var buf bytes.Buffer
+			if err := fs.SaveTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := NewLocalFileSystem(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := loaded.LoadFrom(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := readFile(t, loaded, "/log.txt"); !bytes.Equal(got, want) {
+				t.Errorf("loaded contents differ: %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+}
@@ -2,12 +2,28 @@ package rwfs
 
 import "os"
 
-// FileSystem defines the interface for a read-write file system
+// FileSystem defines the interface for a read-write file system. Names are
+// slash-separated paths, either absolute or relative to the current working
+// directory.
 type FileSystem interface {
-    Open(name string) (File, error)
-    Create(name string) (File, error)
-    Remove(name string) error
-    Stat(name string) (os.FileInfo, error)
-	ListFiles() ([]File, error)
-    Rename(oldName, newName string) error
+	Open(name string) (File, error)
+	Create(name string) (File, error)
+	OpenFileFlags(name string, flag int, perm os.FileMode) (File, error)
+	Remove(name string) error
+	Stat(name string) (os.FileInfo, error)
+	ListFiles() ([]string, error)
+	Rename(oldName, newName string) error
+	Mkdir(name string, perm os.FileMode) error
+	ReadDir(name string) ([]os.DirEntry, error)
+	ChangeDir(name string) error
+	Chmod(name string, mode os.FileMode) error
+	Chown(name, owner string) error
+	Chgrp(name, group string) error
+	Link(oldName, newName string) error
 }
+
+// Both file systems must implement FileSystem
+var (
+	_ FileSystem = (*MemFileSystem)(nil)
+	_ FileSystem = (*LocalFileSystem)(nil)
+)
@@ -0,0 +1,274 @@
+package rwfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+)
+
+// Snapshot file format
+//
+// A snapshot file consists of a fixed header, an extension area, the payload
+// and a trailing checksum. All integers are big endian.
+//
+//	offset  size  field
+//	0       4     magic "RWFS"
+//	4       2     format version
+//	6       2     flags
+//	8       4     length N of the extension area
+//	12      N     extensions, at most 64 KiB
+//	12+N    ...   payload
+//	end-32  32    SHA-256 checksum of everything before it
+//
+// The payload is the gob-encoded stream of snapshot records describing the
+// directory tree. When flagCompressed is set it was compressed, and when
+// flagEncrypted is set it was then encrypted, so a reader learns the settings
+// from the file rather than from its configuration.
+//
+// Extensions are a sequence of tag (1 byte), length (2 bytes) and value
+// records. Readers skip tags they do not know, which lets later versions add
+// header fields without breaking older files. The following tags are defined:
+//
+//	1  journal sequence number (8 bytes) of the last journal record contained
+//	   in the snapshot; see journal.go
+//	2  name of the Codec the payload was compressed with; gzip if absent
+//	3  key derivation parameters: PBKDF2 salt (16 bytes) followed by the
+//	   iteration count (4 bytes). Encrypted snapshots without it use a key
+//	   derived with a single SHA-256 of the passphrase, or a raw key.
+//	4  key ID (8 bytes) of the master key, an HMAC-SHA256 fingerprint that
+//	   tells which key a snapshot expects without revealing it
+//	5  journal key, wrapped with the master key; see journal.go
+//	6  snapshot ID (16 random bytes) the encrypted files of the snapshot are
+//	   bound to; see envelope.go
+//
+// Version history:
+//
+//	1  the payload is encrypted with a single AES-256-GCM seal, so it has to
+//	   be processed as a whole
+//	2  the payload is encrypted as a segmented stream (see stream.go), so
+//	   snapshots can be written and read without buffering them in memory
+//	3  the checksum covers the header and the extension area as well, not
+//	   only the payload
+//
+// Files that do not start with the magic are legacy snapshots written before
+// this format existed. They are a bare payload that was compressed and
+// encrypted according to the FileSystemConfig used to write them.
+const (
+	snapshotMagic      = "RWFS"
+	snapshotVersion    = 3
+	snapshotHeaderSize = 12
+	maxExtensionSize   = 64 << 10
+)
+
+// Snapshot header flags
+const (
+	flagCompressed uint16 = 1 << iota
+	flagEncrypted
+)
+
+// Snapshot header extension tags
+const (
+	extJournalSeq uint8 = 1
+	extCodec      uint8 = 2
+	extKDF        uint8 = 3
+	extKeyID      uint8 = 4
+	extJournalKey uint8 = 5
+	extSnapshotID uint8 = 6
+)
+
+// snapshotHeader holds the decoded header of a snapshot file
+type snapshotHeader struct {
+	Version    uint16
+	Flags      uint16
+	Extensions map[uint8][]byte
+	raw        []byte // header as read, covered by the checksum since version 3
+}
+
+// writeSnapshotHeader writes the fixed header and the extension area to w
+func writeSnapshotHeader(w io.Writer, header snapshotHeader) error {
+	var ext []byte
+	for tag, value := range header.Extensions {
+		ext = append(ext, tag)
+		ext = binary.BigEndian.AppendUint16(ext, uint16(len(value)))
+		ext = append(ext, value...)
+	}
+
+	buf := make([]byte, 0, snapshotHeaderSize+len(ext))
+	buf = append(buf, snapshotMagic...)
+	buf = binary.BigEndian.AppendUint16(buf, header.Version)
+	buf = binary.BigEndian.AppendUint16(buf, header.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(ext)))
+	buf = append(buf, ext...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readSnapshotHeader reads the fixed header and the extension area from r
+func readSnapshotHeader(r io.Reader) (snapshotHeader, error) {
+	var header snapshotHeader
+	fixed := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return header, ErrSnapshotCorrupt
+	}
+	if !bytes.HasPrefix(fixed, []byte(snapshotMagic)) {
+		return header, ErrSnapshotCorrupt
+	}
+	header.Version = binary.BigEndian.Uint16(fixed[4:])
+	header.Flags = binary.BigEndian.Uint16(fixed[6:])
+	if header.Version == 0 || header.Version > snapshotVersion {
+		return header, ErrSnapshotVersion
+	}
+
+	// The length is not authenticated, so bound it before allocating
+	size := binary.BigEndian.Uint32(fixed[8:])
+	if size > maxExtensionSize {
+		return header, ErrSnapshotCorrupt
+	}
+	raw := make([]byte, snapshotHeaderSize+int(size))
+	copy(raw, fixed)
+	ext := raw[snapshotHeaderSize:]
+	if _, err := io.ReadFull(r, ext); err != nil {
+		return header, ErrSnapshotCorrupt
+	}
+	header.raw = raw
+	header.Extensions = make(map[uint8][]byte)
+	for len(ext) > 0 {
+		if len(ext) < 3 {
+			return header, ErrSnapshotCorrupt
+		}
+		tag, size := ext[0], int(binary.BigEndian.Uint16(ext[1:]))
+		if len(ext) < 3+size {
+			return header, ErrSnapshotCorrupt
+		}
+		header.Extensions[tag] = ext[3 : 3+size]
+		ext = ext[3+size:]
+	}
+	return header, nil
+}
+
+// journalSeq returns the journal sequence number stored in the header, or
+// zero if there is none
+func (header snapshotHeader) journalSeq() uint64 {
+	if value := header.Extensions[extJournalSeq]; len(value) == 8 {
+		return binary.BigEndian.Uint64(value)
+	}
+	return 0
+}
+
+// kdf returns the key derivation parameters stored in the header
+func (header snapshotHeader) kdf() ([]byte, int, bool) {
+	value := header.Extensions[extKDF]
+	if len(value) != keySaltSize+4 {
+		return nil, 0, false
+	}
+	return value[:keySaltSize], int(binary.BigEndian.Uint32(value[keySaltSize:])), true
+}
+
+// snapshotID returns the snapshot ID stored in the header, or nil
+func (header snapshotHeader) snapshotID() []byte {
+	if value := header.Extensions[extSnapshotID]; len(value) == snapshotIDSize {
+		return value
+	}
+	return nil
+}
+
+// codec returns the codec the payload was compressed with
+func (header snapshotHeader) codec() (Codec, error) {
+	return LookupCodec(string(header.Extensions[extCodec]))
+}
+
+// isSnapshot reports whether r starts with the snapshot magic
+func isSnapshot(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(snapshotMagic))
+	return err == nil && string(magic) == snapshotMagic
+}
+
+// checksumWriter hashes the header and the payload on their way to the
+// underlying writer
+type checksumWriter struct {
+	w    io.Writer
+	hash hash.Hash
+}
+
+func newChecksumWriter(w io.Writer) *checksumWriter {
+	return &checksumWriter{w: w, hash: sha256.New()}
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.hash.Write(p[:n])
+	return n, err
+}
+
+// writeTrailer appends the checksum of everything written so far
+func (c *checksumWriter) writeTrailer() error {
+	_, err := c.w.Write(c.hash.Sum(nil))
+	return err
+}
+
+// checksumReader returns the payload of a snapshot while holding back the
+// trailing checksum, hashing every byte it hands out. The header is hashed
+// first for snapshots whose checksum covers it.
+type checksumReader struct {
+	r      io.Reader
+	hash   hash.Hash
+	chunk  []byte
+	buf    []byte
+	eof    bool
+	header snapshotHeader
+}
+
+func newChecksumReader(r io.Reader, header snapshotHeader) *checksumReader {
+	c := &checksumReader{r: r, hash: sha256.New(), chunk: make([]byte, 32<<10), header: header}
+	if header.Version >= 3 {
+		c.hash.Write(header.raw)
+	}
+	return c
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	for len(c.buf) <= sha256.Size && !c.eof {
+		n, err := c.r.Read(c.chunk)
+		c.buf = append(c.buf, c.chunk[:n]...)
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	avail := len(c.buf) - sha256.Size
+	if avail <= 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.buf[:avail])
+	c.hash.Write(p[:n])
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// verifyHeader checks the header by verifying the whole snapshot, for
+// snapshots whose checksum covers it; it returns nil for older ones
+func (c *checksumReader) verifyHeader() error {
+	if c.header.Version < 3 {
+		return nil
+	}
+	return c.verify()
+}
+
+// verify consumes the rest of the payload and compares the trailer with the
+// checksum of everything read
+func (c *checksumReader) verify() error {
+	if _, err := io.Copy(io.Discard, c); err != nil {
+		return err
+	}
+	if len(c.buf) != sha256.Size {
+		return ErrSnapshotCorrupt
+	}
+	if !bytes.Equal(c.hash.Sum(nil), c.buf) {
+		return ErrSnapshotChecksum
+	}
+	return nil
+}
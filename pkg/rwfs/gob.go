@@ -3,13 +3,51 @@ package rwfs
 import (
 	"bytes"
 	"encoding/gob"
+	"io"
+	"os"
 )
 
+// storedPermission is the persisted form of the permissions of a file. Read,
+// Write and Execute repeat the owner bits of Mode, which is all that files
+// saved before permission modes existed have. A zero Mode has none of them
+// set either, so such files are told apart by Mode being zero.
+type storedPermission struct {
+	Read    bool
+	Write   bool
+	Execute bool
+	Mode    os.FileMode
+	Group   string
+}
+
+// storedBlocks is the persisted form of compressed or encrypted file
+// contents. An empty Codec stands for gzip, the only codec before the registry
+// existed, unless Plain says the blocks are not compressed. DataKey is the
+// wrapped data key of encrypted contents and Seal the format they are sealed
+// in. Versions holds the version of every block of versioned contents, and
+// Version the version of the block stored last.
+type storedBlocks struct {
+	Size     int64
+	Blocks   [][]byte
+	Codec    string
+	Level    int
+	Plain    bool
+	DataKey  []byte
+	Seal     int
+	Versions []uint64
+	Version  uint64
+}
+
 // Custom Gob Encode method for MemFile
 func (f *MemFile) GobEncode() ([]byte, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	// Contents are encoded in their stored form, which the pending block
+	// does not have yet
+	if err := f.data.flush(); err != nil {
+		return nil, err
+	}
+
 	var buf bytes.Buffer
 	encoder := gob.NewEncoder(&buf)
 
@@ -35,15 +73,37 @@ func (f *MemFile) GobEncode() ([]byte, error) {
 	if err := encoder.Encode(f.closed); err != nil {
 		return nil, err
 	}
-	if err := encoder.Encode(f.permissions); err != nil {
+	perm := ownerPermission(f.mode)
+	stored := storedPermission{Read: perm.Read, Write: perm.Write, Execute: perm.Execute, Mode: f.mode, Group: f.group}
+	if err := encoder.Encode(stored); err != nil {
 		return nil, err
 	}
 
-	// Encode the Data field as a byte slice
-	if err := encoder.Encode(f.Data.Bytes()); err != nil {
+	// Encode the contents as a byte slice
+	if err := encoder.Encode(f.data.plain); err != nil {
 		return nil, err
 	}
 
+	// Compressed or encrypted contents follow in their stored form
+	if codec := f.data.codec; codec != nil {
+		blocks := storedBlocks{
+			Size:     f.data.size,
+			Blocks:   f.data.blocks,
+			Level:    codec.level,
+			Plain:    codec.codec == nil,
+			DataKey:  codec.wrapped,
+			Seal:     codec.seal,
+			Versions: f.data.versions,
+			Version:  f.data.version,
+		}
+		if codec.codec != nil {
+			blocks.Codec = codec.codec.Name()
+		}
+		if err := encoder.Encode(blocks); err != nil {
+			return nil, err
+		}
+	}
+
 	return buf.Bytes(), nil
 }
 
@@ -78,16 +138,41 @@ func (f *MemFile) GobDecode(data []byte) error {
 		return err
 	}
 
-	// Encode the permissions
-	if err := decoder.Decode(&f.permissions); err != nil {
+	// Decode the permissions
+	var perm storedPermission
+	if err := decoder.Decode(&perm); err != nil {
+		return err
+	}
+	f.mode, f.group = perm.Mode, perm.Group
+	if f.mode == 0 {
+		f.mode = legacyMode(FilePermission{Read: perm.Read, Write: perm.Write, Execute: perm.Execute}.Mode())
+	}
+	// Decode the contents as a byte slice
+	if err := decoder.Decode(&f.data.plain); err != nil {
 		return err
 	}
-	// Decode the Data field as a byte slice
-	var dataBytes []byte
-	if err := decoder.Decode(&dataBytes); err != nil {
+
+	// Files written before compression at rest existed end here
+	var blocks storedBlocks
+	if err := decoder.Decode(&blocks); err == io.EOF {
+		return nil
+	} else if err != nil {
 		return err
 	}
-	f.Data = bytes.NewBuffer(dataBytes)
+	// Wrapped data keys are unwrapped once the whole tree is decoded, see
+	// unsealTree
+	codec := &blockCodec{level: blocks.Level, wrapped: blocks.DataKey, seal: blocks.Seal}
+	if !blocks.Plain {
+		var err error
+		if codec.codec, err = LookupCodec(blocks.Codec); err != nil {
+			return err
+		}
+	}
+	f.data = newFileData(codec)
+	f.data.blocks = blocks.Blocks
+	f.data.size = blocks.Size
+	f.data.versions = blocks.Versions
+	f.data.version = blocks.Version
 
 	return nil
 }
@@ -0,0 +1,125 @@
+package rwfs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// ContentMatch represents a line of file content matching a search
+type ContentMatch struct {
+	Path   string
+	Line   int   // line number, starting at 1
+	Offset int64 // byte offset of the start of the line
+	Text   string
+}
+
+// ContentSearchOptions holds the options applied by SearchContent. The
+// embedded SearchOptions select which files are scanned.
+type ContentSearchOptions struct {
+	SearchOptions
+	MaxMatchesPerFile int // stop scanning a file after this many matches, 0 for no limit
+}
+
+// SearchContent scans the contents of every file below root in parallel and
+// returns the lines matching re, sorted by path and line number. Files are
+// read through the regular file API, so content stored compressed or
+// encrypted is scanned in its plain form. Files without read permission are
+// skipped. A file that fails to read does not stop the search: the matches
+// found elsewhere are returned together with an error joining an
+// *os.PathError for every such file.
+func (fs *MemFileSystem) SearchContent(root string, re *regexp.Regexp, opts ContentSearchOptions) ([]ContentMatch, error) {
+	filter := opts.SearchOptions
+	filter.Type = SearchFiles
+	files, err := fs.SearchTree(root, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	paths := make(chan string, workers)
+	var (
+		matches []ContentMatch
+		errs    []error
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range paths {
+				found, err := fs.grepFile(name, re, opts.MaxMatchesPerFile)
+				mu.Lock()
+				matches = append(matches, found...)
+				if err != nil {
+					errs = append(errs, &os.PathError{Op: "read", Path: name, Err: err})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, file := range files {
+		paths <- file.Path
+	}
+	close(paths)
+	wg.Wait()
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Path != matches[j].Path {
+			return matches[i].Path < matches[j].Path
+		}
+		return matches[i].Line < matches[j].Line
+	})
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].(*os.PathError).Path < errs[j].(*os.PathError).Path
+	})
+	return matches, errors.Join(errs...)
+}
+
+// grepFile scans a single file line by line
+func (fs *MemFileSystem) grepFile(name string, re *regexp.Regexp, limit int) ([]ContentMatch, error) {
+	file, err := fs.OpenFile(name)
+	if err != nil {
+		// Unreadable or vanished files are skipped
+		return nil, nil
+	}
+	defer file.Close()
+
+	var matches []ContentMatch
+	reader := bufio.NewReader(file)
+	var offset int64
+	for line := 1; ; line++ {
+		text, err := reader.ReadBytes('\n')
+		if len(text) > 0 {
+			trimmed := bytes.TrimRight(text, "\r\n")
+			if re.Match(trimmed) {
+				matches = append(matches, ContentMatch{
+					Path:   name,
+					Line:   line,
+					Offset: offset,
+					Text:   string(trimmed),
+				})
+				if limit > 0 && len(matches) >= limit {
+					return matches, nil
+				}
+			}
+			offset += int64(len(text))
+		}
+		if err == io.EOF {
+			return matches, nil
+		}
+		if err != nil {
+			return matches, err
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package rwfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestSearchContent(t *testing.T) {
+	mem := NewMemFileSystem(FileSystemConfig{})
+	for _, dir := range []string{"/logs", "/other"} {
+		if err := mem.CreateDir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, contents := range map[string]string{
+		"/logs/a.log":      "INFO start\nERROR disk full\r\nINFO ok\nERROR again",
+		"/logs/b.txt":      "ERROR in a text file\n",
+		"/logs/secret.log": "ERROR hidden\n",
+		"/other/c.log":     "ERROR outside\n",
+	} {
+		file, err := mem.CreateFile(name, "", ReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mem.Chmod("/logs/secret.log", 0200); err != nil {
+		t.Fatal(err)
+	}
+
+	re := regexp.MustCompile(`^ERROR`)
+	opts := ContentSearchOptions{SearchOptions: SearchOptions{Glob: "*.log"}}
+	matches, err := mem.SearchContent("/logs", re, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ContentMatch{
+		{Path: "/logs/a.log", Line: 2, Offset: 11, Text: "ERROR disk full"},
+		{Path: "/logs/a.log", Line: 4, Offset: 36, Text: "ERROR again"},
+	}
+	if !reflect.DeepEqual(matches, want) {
+		t.Errorf("matches = %+v, want %+v", matches, want)
+	}
+
+	opts.MaxMatchesPerFile = 1
+	if matches, err = mem.SearchContent("/logs", re, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(matches, want[:1]) {
+		t.Errorf("one match per file: matches = %+v, want %+v", matches, want[:1])
+	}
+
+	if _, err := mem.SearchContent("/missing", re, ContentSearchOptions{}); err == nil {
+		t.Error("SearchContent of a missing root succeeded")
+	}
+}
+
+func TestSearchContentStored(t *testing.T) {
+	// Lines spanning block boundaries of compressed and encrypted contents
+	// are found in their plain form
+	for _, test := range testConfigs {
+		t.Run(test.name, func(t *testing.T) {
+			fs, err := NewLocalFileSystem(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filler := bytes.Repeat([]byte("filler line\n"), blockSize/12)
+			file, err := fs.CreateFile("/big.txt", "", ReadWrite)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, part := range [][]byte{filler, []byte("the needle crosses the boundary\n"), filler} {
+				if _, err := file.Write(part); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			matches, err := fs.SearchContent("/", regexp.MustCompile("needle"), ContentSearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(matches) != 1 || matches[0].Line != blockSize/12+1 || matches[0].Offset != int64(len(filler)) {
+				t.Errorf("matches = %+v, want line %d at offset %d", matches, blockSize/12+1, len(filler))
+			}
+		})
+	}
+}
+
+func TestSearchContentPartial(t *testing.T) {
+	local, err := NewLocalFileSystem(FileSystemConfig{Encryption: true, EncryptionKey: "secret", KeyIterations: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a.txt", "/b.txt", "/c.txt"} {
+		file, err := local.CreateFile(name, "", ReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write([]byte("needle in " + name + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := &local.RootDir.Entries["b.txt"].data
+	data.blocks[0] = bytes.Clone(data.blocks[0])
+	data.blocks[0][len(data.blocks[0])-1] ^= 1
+
+	matches, err := local.SearchContent("/", regexp.MustCompile("needle"), ContentSearchOptions{})
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) || pathErr.Path != "/b.txt" || !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("error = %v, want an *os.PathError for /b.txt wrapping ErrDecryptFailed", err)
+	}
+	if len(matches) != 2 || matches[0].Path != "/a.txt" || matches[1].Path != "/c.txt" {
+		t.Errorf("matches = %+v, want the lines of /a.txt and /c.txt", matches)
+	}
+}
@@ -0,0 +1,220 @@
+package rwfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+)
+
+// FileHandle is an open file returned by OpenFile and CreateFile. Every handle
+// has its own offset, access mode and closed state, while the content is
+// shared with all other handles through the underlying MemFile.
+type FileHandle struct {
+	fs     *MemFileSystem
+	file   *MemFile
+	name   string
+	flag   int
+	mu     RWMutex
+	offset int64
+	closed bool
+}
+
+// newFileHandle opens a new handle on file. The access mode is taken from the
+// os.O_RDONLY, os.O_WRONLY and os.O_RDWR bits of flag.
+func newFileHandle(fs *MemFileSystem, file *MemFile, name string, flag int) *FileHandle {
+	return &FileHandle{
+		fs:   fs,
+		file: file,
+		name: name,
+		flag: flag,
+	}
+}
+
+// Name returns the path the handle was opened with
+func (h *FileHandle) Name() string {
+	return h.name
+}
+
+// canRead reports whether the access mode of the handle allows reading
+func (h *FileHandle) canRead() bool {
+	return h.flag&(os.O_RDONLY|os.O_WRONLY|os.O_RDWR) != os.O_WRONLY
+}
+
+// canWrite reports whether the access mode of the handle allows writing
+func (h *FileHandle) canWrite() bool {
+	mode := h.flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	return mode == os.O_WRONLY || mode == os.O_RDWR
+}
+
+// Read reads from the file starting at the handle's offset
+func (h *FileHandle) Read(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return 0, os.ErrClosed
+	}
+	if !h.canRead() {
+		return 0, errors.New("file not opened for reading")
+	}
+	n, err := h.file.ReadAt(p, h.offset)
+	h.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Write writes to the file starting at the handle's offset, or at the end of
+// the file when the handle was opened with os.O_APPEND
+func (h *FileHandle) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return 0, os.ErrClosed
+	}
+	if !h.canWrite() {
+		return 0, errors.New("file not opened for writing")
+	}
+	h.fs.mu.RLock()
+	off, n, err := h.fs.writeFile(h.file, p, h.offset, h.flag&os.O_APPEND != 0)
+	h.fs.mu.RUnlock()
+	h.offset = off + int64(n)
+	return n, err
+}
+
+// ReadAt reads len(p) bytes starting at offset off without moving the
+// handle's offset
+func (h *FileHandle) ReadAt(p []byte, off int64) (int, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return 0, os.ErrClosed
+	}
+	if !h.canRead() {
+		return 0, errors.New("file not opened for reading")
+	}
+	return h.file.ReadAt(p, off)
+}
+
+// WriteAt writes p starting at offset off without moving the handle's offset
+func (h *FileHandle) WriteAt(p []byte, off int64) (int, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return 0, os.ErrClosed
+	}
+	if !h.canWrite() {
+		return 0, errors.New("file not opened for writing")
+	}
+	if h.flag&os.O_APPEND != 0 {
+		return 0, errors.New("invalid use of WriteAt on file opened with O_APPEND")
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	h.fs.mu.RLock()
+	defer h.fs.mu.RUnlock()
+	_, n, err := h.fs.writeFile(h.file, p, off, false)
+	return n, err
+}
+
+// Truncate changes the size of the file
+func (h *FileHandle) Truncate(size int64) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return os.ErrClosed
+	}
+	if !h.canWrite() {
+		return errors.New("file not opened for writing")
+	}
+	h.fs.mu.RLock()
+	defer h.fs.mu.RUnlock()
+	return h.fs.truncateFile(h.file, size)
+}
+
+// writeFile writes p to file at offset off, or at the end of the file when
+// appending, and records the write. It returns the offset p was written at.
+// The caller must hold the lock of the file system, at least for reading, so
+// that closing it waits for the write.
+func (fs *MemFileSystem) writeFile(file *MemFile, p []byte, off int64, appending bool) (int64, int, error) {
+	if err := fs.mutable(); err != nil {
+		return off, 0, err
+	}
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if appending {
+		off = file.data.len()
+	}
+	n, err := file.writeAt(p, off)
+	// Record while holding the file lock so that the journal sees writes to
+	// the same file in the order they were applied
+	if rerr := fs.record(journalRecord{Op: journalWrite, Ino: file.ino, Offset: off, Data: p[:n]}); err == nil {
+		err = rerr
+	}
+	return off, n, err
+}
+
+// truncateFile changes the size of file and records the change; the caller
+// must hold the lock of the file system, at least for reading
+func (fs *MemFileSystem) truncateFile(file *MemFile, size int64) error {
+	if size < 0 {
+		return errors.New("negative size")
+	}
+	if err := fs.mutable(); err != nil {
+		return err
+	}
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if err := file.truncate(size); err != nil {
+		return err
+	}
+	return fs.record(journalRecord{Op: journalTruncate, Ino: file.ino, Offset: size})
+}
+
+// Seek sets the offset for the next Read or Write on the handle
+func (h *FileHandle) Seek(offset int64, whence int) (int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return 0, os.ErrClosed
+	}
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = h.offset + offset
+	case io.SeekEnd:
+		abs = h.file.Size() + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+	h.offset = abs
+	return abs, nil
+}
+
+// Stat returns information about the file, named after the handle's path
+func (h *FileHandle) Stat() (os.FileInfo, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return nil, os.ErrClosed
+	}
+	return fileInfo(path.Base(h.name), h.file), nil
+}
+
+// Close closes the handle. Other handles on the same file are not affected.
+func (h *FileHandle) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return os.ErrClosed
+	}
+	h.closed = true
+	return nil
+}
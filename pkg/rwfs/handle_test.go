@@ -0,0 +1,138 @@
+package rwfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+)
+
+// openHandle opens name with flag and returns the handle
+func openHandle(t *testing.T, fs *MemFileSystem, name string, flag int) *FileHandle {
+	t.Helper()
+	file, err := fs.OpenFileFlags(name, flag, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file.(*FileHandle)
+}
+
+func TestFileHandleOffsets(t *testing.T) {
+	fs := NewMemFileSystem(FileSystemConfig{})
+	writer := openHandle(t, fs, "/a.txt", os.O_RDWR|os.O_CREATE)
+	reader := openHandle(t, fs, "/a.txt", os.O_RDONLY)
+	if _, err := writer.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("Read = %q, %v; want %q", buf, err, "hello")
+	}
+	if off, _ := writer.Seek(0, io.SeekCurrent); off != 11 {
+		t.Errorf("writer offset = %d, want 11", off)
+	}
+	if off, _ := reader.Seek(0, io.SeekCurrent); off != 5 {
+		t.Errorf("reader offset = %d, want 5", off)
+	}
+
+	// Closing one handle leaves the other usable
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write([]byte("!")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write on a closed handle: error = %v, want os.ErrClosed", err)
+	}
+	if _, err := writer.Read(buf); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Read on a closed handle: error = %v, want os.ErrClosed", err)
+	}
+	rest, err := io.ReadAll(reader)
+	if err != nil || string(rest) != " world" {
+		t.Errorf("Read after closing the other handle = %q, %v; want %q", rest, err, " world")
+	}
+	if _, err := reader.Write([]byte("x")); err == nil {
+		t.Error("Write on a read-only handle succeeded")
+	}
+}
+
+func TestFileHandleConcurrent(t *testing.T) {
+	for _, test := range testConfigs {
+		t.Run(test.name, func(t *testing.T) {
+			local, err := NewLocalFileSystem(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs := local.MemFileSystem
+			if _, err := fs.CreateFile("/a.bin", "", ReadWrite); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fs.CreateFile("/log.txt", "", ReadWrite); err != nil {
+				t.Fatal(err)
+			}
+
+			// Every writer fills its own region of a.bin through WriteAt and
+			// appends records to log.txt, while readers scan a.bin
+			const writers, region = 8, 10000
+			var wg sync.WaitGroup
+			for i := 0; i < writers; i++ {
+				wg.Add(2)
+				go func(i int) {
+					defer wg.Done()
+					data, err := fs.OpenFileFlags("/a.bin", os.O_RDWR, 0)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer data.Close()
+					log, err := fs.OpenFileFlags("/log.txt", os.O_WRONLY|os.O_APPEND, 0)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer log.Close()
+					if _, err := data.(*FileHandle).WriteAt(bytes.Repeat([]byte{byte('a' + i)}, region), int64(i*region)); err != nil {
+						t.Error(err)
+					}
+					for j := 0; j < 50; j++ {
+						if _, err := fmt.Fprintf(log, "writer %d record %02d\n", i, j); err != nil {
+							t.Error(err)
+						}
+					}
+				}(i)
+				go func() {
+					defer wg.Done()
+					reader, err := fs.OpenFileFlags("/a.bin", os.O_RDONLY, 0)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer reader.Close()
+					if _, err := io.ReadAll(reader); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			data := readFile(t, fs, "/a.bin")
+			for i := 0; i < writers; i++ {
+				if !bytes.Equal(data[i*region:(i+1)*region], bytes.Repeat([]byte{byte('a' + i)}, region)) {
+					t.Errorf("region %d differs", i)
+				}
+			}
+			lines := bytes.Split(bytes.TrimSuffix(readFile(t, fs, "/log.txt"), []byte("\n")), []byte("\n"))
+			if len(lines) != writers*50 {
+				t.Fatalf("log has %d lines, want %d", len(lines), writers*50)
+			}
+			for _, line := range lines {
+				var i, j int
+				if n, err := fmt.Sscanf(string(line), "writer %d record %d", &i, &j); n != 2 || err != nil {
+					t.Fatalf("garbled log line %q", line)
+				}
+			}
+		})
+	}
+}
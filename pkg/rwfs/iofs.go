@@ -0,0 +1,273 @@
+package rwfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+)
+
+// IOFS adapts a MemFileSystem to the standard io/fs interfaces so that it can
+// be handed to consumers such as template.ParseFS or http.FS. A
+// LocalFileSystem can be adapted through its embedded MemFileSystem.
+//
+// Names follow the io/fs conventions: they are unrooted, slash-separated and
+// always resolved from the adapter's root, independent of the current working
+// directory.
+type IOFS struct {
+	mem  *MemFileSystem
+	root string
+}
+
+var (
+	_ fs.FS         = (*IOFS)(nil)
+	_ fs.ReadDirFS  = (*IOFS)(nil)
+	_ fs.StatFS     = (*IOFS)(nil)
+	_ fs.ReadFileFS = (*IOFS)(nil)
+	_ fs.GlobFS     = (*IOFS)(nil)
+	_ fs.SubFS      = (*IOFS)(nil)
+)
+
+// NewIOFS creates an io/fs view of the given file system rooted at "/"
+func NewIOFS(mem *MemFileSystem) *IOFS {
+	return &IOFS{mem: mem, root: "/"}
+}
+
+// resolve validates name and returns the absolute path it refers to
+func (fsys *IOFS) resolve(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return path.Join(fsys.root, name), nil
+}
+
+// lookup resolves name while holding the file system read lock. Only search
+// permission on the directories on the way is checked.
+func (fsys *IOFS) lookup(op, name string) (*MemDirectory, *MemFile, error) {
+	full, err := fsys.resolve(op, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir, file, err := fsys.mem.lookup(full)
+	if err != nil {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return dir, file, nil
+}
+
+// Open opens the named file or directory for reading
+func (fsys *IOFS) Open(name string) (fs.File, error) {
+	fsys.mem.mu.RLock()
+	defer fsys.mem.mu.RUnlock()
+
+	dir, file, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if dir != nil {
+		if !dir.allows(permRead) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+		}
+		return &ioDir{
+			name:    name,
+			info:    dirInfo(path.Base(name), dir),
+			entries: readDir(dir),
+		}, nil
+	}
+	if !file.allows(permRead) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return &ioFile{
+		handle: newFileHandle(fsys.mem, file, name, os.O_RDONLY),
+		name:   name,
+		info:   fileInfo(path.Base(name), file),
+	}, nil
+}
+
+// Stat returns information about the named file or directory
+func (fsys *IOFS) Stat(name string) (fs.FileInfo, error) {
+	fsys.mem.mu.RLock()
+	defer fsys.mem.mu.RUnlock()
+
+	dir, file, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if dir != nil {
+		return dirInfo(path.Base(name), dir), nil
+	}
+	return fileInfo(path.Base(name), file), nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name
+func (fsys *IOFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	fsys.mem.mu.RLock()
+	defer fsys.mem.mu.RUnlock()
+
+	dir, _, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if dir == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: ErrNotDir}
+	}
+	if !dir.allows(permRead) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrPermission}
+	}
+	return readDir(dir), nil
+}
+
+// ReadFile reads the named file and returns a copy of its contents
+func (fsys *IOFS) ReadFile(name string) ([]byte, error) {
+	fsys.mem.mu.RLock()
+	defer fsys.mem.mu.RUnlock()
+
+	dir, file, err := fsys.lookup("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	if dir != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: errors.New("is a directory")}
+	}
+	if !file.allows(permRead) {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrPermission}
+	}
+	data, err := file.contents()
+	if err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+// Glob returns the names of all files matching pattern
+func (fsys *IOFS) Glob(pattern string) ([]string, error) {
+	// Hide the Glob method so fs.Glob falls back to walking ReadDir
+	return fs.Glob(struct{ fs.ReadDirFS }{fsys}, pattern)
+}
+
+// Sub returns an IOFS rooted at the named directory
+func (fsys *IOFS) Sub(dir string) (fs.FS, error) {
+	info, err := fsys.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: ErrNotDir}
+	}
+	return &IOFS{mem: fsys.mem, root: path.Join(fsys.root, dir)}, nil
+}
+
+// fileInfo returns information about file named name, which differs from the
+// name it was created with for hard links and renamed files. Stat returns a
+// fresh copy, so the name can be set on it.
+func fileInfo(name string, file *MemFile) *MemFileInfo {
+	info, _ := file.Stat()
+	mi := info.(*MemFileInfo)
+	mi.name = name
+	return mi
+}
+
+// dirInfo returns information about dir named name, so that the root
+// directory reports the name it was opened with
+func dirInfo(name string, dir *MemDirectory) *MemFileInfo {
+	info, _ := dir.Stat()
+	mi := info.(*MemFileInfo)
+	mi.name = name
+	return mi
+}
+
+// readDir returns the entries of dir sorted by name
+func readDir(dir *MemDirectory) []fs.DirEntry {
+	entries := make([]fs.DirEntry, 0, len(dir.Entries)+len(dir.Dirs))
+	for name, file := range dir.Entries {
+		entries = append(entries, fs.FileInfoToDirEntry(fileInfo(name, file)))
+	}
+	for name, sub := range dir.Dirs {
+		entries = append(entries, fs.FileInfoToDirEntry(dirInfo(name, sub)))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+// ioFile is a file returned by IOFS.Open. It reads the MemFile through a
+// read-only handle, so only the blocks that are read get decoded, and it
+// implements io.ReaderAt and io.Seeker as well.
+type ioFile struct {
+	handle *FileHandle
+	name   string
+	info   fs.FileInfo
+}
+
+func (f *ioFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *ioFile) Read(p []byte) (int, error) {
+	n, err := f.handle.Read(p)
+	return n, f.wrap("read", err)
+}
+
+func (f *ioFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.handle.ReadAt(p, off)
+	return n, f.wrap("read", err)
+}
+
+func (f *ioFile) Seek(offset int64, whence int) (int64, error) {
+	abs, err := f.handle.Seek(offset, whence)
+	return abs, f.wrap("seek", err)
+}
+
+func (f *ioFile) Close() error {
+	return f.wrap("close", f.handle.Close())
+}
+
+// wrap returns err as an *fs.PathError for op, leaving nil and io.EOF as
+// they are
+func (f *ioFile) wrap(op string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return &fs.PathError{Op: op, Path: f.name, Err: err}
+}
+
+// ioDir is a directory returned by IOFS.Open
+type ioDir struct {
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+	closed  bool
+}
+
+func (d *ioDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *ioDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *ioDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: fs.ErrClosed}
+	}
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
+
+func (d *ioDir) Close() error {
+	if d.closed {
+		return &fs.PathError{Op: "close", Path: d.name, Err: fs.ErrClosed}
+	}
+	d.closed = true
+	return nil
+}
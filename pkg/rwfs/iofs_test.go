@@ -0,0 +1,146 @@
+package rwfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+// newTestTree returns a file system holding a small tree with nested
+// directories, an empty directory and a hard link
+func newTestTree(t *testing.T) *MemFileSystem {
+	t.Helper()
+	mem := NewMemFileSystem(FileSystemConfig{})
+	for _, dir := range []string{"/a", "/a/b", "/empty"} {
+		if err := mem.CreateDir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, contents := range map[string]string{"/a/b/c.txt": "hello", "/top.txt": "top"} {
+		file, err := mem.CreateFile(name, "owner", ReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mem.Link("/top.txt", "/a/link.txt"); err != nil {
+		t.Fatal(err)
+	}
+	return mem
+}
+
+func TestIOFS(t *testing.T) {
+	fsys := NewIOFS(newTestTree(t))
+	if err := fstest.TestFS(fsys, "a/b/c.txt", "top.txt", "a/link.txt", "empty"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIOFSSub(t *testing.T) {
+	sub, err := NewIOFS(newTestTree(t)).Sub("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(sub, "b/c.txt", "link.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIOFSPermissions(t *testing.T) {
+	mem := newTestTree(t)
+	if err := mem.Chmod("/top.txt", 0200); err != nil {
+		t.Fatal(err)
+	}
+	fsys := NewIOFS(mem)
+
+	info, err := fs.Stat(fsys, "top.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0200 {
+		t.Errorf("mode = %v, want 0200", info.Mode().Perm())
+	}
+	if _, err := fs.ReadFile(fsys, "top.txt"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("ReadFile error = %v, want fs.ErrPermission", err)
+	}
+	if _, err := fsys.Open("../top.txt"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Open error = %v, want fs.ErrInvalid", err)
+	}
+}
+
+func TestIOFSTamperedContents(t *testing.T) {
+	local, err := NewLocalFileSystem(FileSystemConfig{Encryption: true, EncryptionKey: "secret", KeyIterations: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := local.CreateFile("/a.txt", "", ReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("sealed contents")); err != nil {
+		t.Fatal(err)
+	}
+	data := &local.RootDir.Entries["a.txt"].data
+	data.blocks[0] = bytes.Clone(data.blocks[0])
+	data.blocks[0][len(data.blocks[0])-1] ^= 1
+
+	fsys := NewIOFS(local.MemFileSystem)
+	if _, err := fs.ReadFile(fsys, "a.txt"); !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("ReadFile error = %v, want ErrDecryptFailed", err)
+	}
+
+	// Open only reads blocks when asked to, so the damage shows on Read
+	opened, err := fsys.Open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer opened.Close()
+	if _, err := io.ReadAll(opened); !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("Read error = %v, want ErrDecryptFailed", err)
+	}
+}
+
+func TestIOFSFileSeek(t *testing.T) {
+	for _, test := range testConfigs {
+		t.Run(test.name, func(t *testing.T) {
+			local, err := NewLocalFileSystem(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := pattern(3*blockSize+100, 1)
+			file, err := local.CreateFile("/big.bin", "", ReadWrite)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := file.Write(data); err != nil {
+				t.Fatal(err)
+			}
+
+			opened, err := NewIOFS(local.MemFileSystem).Open("big.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer opened.Close()
+			seeker, ok := opened.(io.ReadSeeker)
+			if !ok {
+				t.Fatal("IOFS file does not implement io.Seeker")
+			}
+			off := int64(2*blockSize - 10)
+			if _, err := seeker.Seek(off, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 20)
+			if _, err := io.ReadFull(seeker, buf); err != nil || !bytes.Equal(buf, data[off:off+20]) {
+				t.Errorf("Read across a block boundary = %v, %v", buf, err)
+			}
+			if _, err := opened.(io.ReaderAt).ReadAt(buf, int64(len(data))-10); err != io.EOF || !bytes.Equal(buf[:10], data[len(data)-10:]) {
+				t.Errorf("ReadAt at the end: error = %v, want io.EOF", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package rwfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// Journal file format
+//
+// A journal records every mutation applied to a LocalFileSystem since its
+// last snapshot. It starts with the magic "RWFJ" and a flags byte whose
+// lowest bit tells whether record bodies are encrypted. When the second bit
+// is set, the 8-byte key ID of the journal key follows. Records follow as
+//
+//	length  uint32  length of the body
+//	crc     uint32  CRC-32 (IEEE) of the body
+//	body    ...     encoded journalRecord, sealed with AES-GCM when encrypted
+//
+// A record body holds the operation, the mode, the sequence number, the inode
+// number and the offset, followed by the path, target, owner and data fields,
+// each prefixed with its uint32 length.
+//
+// Sequence numbers increase by one with every record. A snapshot stores the
+// sequence number of the last record it contains, so replay skips the records
+// it already holds. A torn or corrupt record marks the end of the journal; it
+// and anything after it is discarded when the journal is opened.
+//
+// Records are encrypted with a random journal key that is stored, wrapped
+// with the master key, in the snapshot, so rotating the master key does not
+// touch the journal. Journals written before journal keys existed have no key
+// ID and are encrypted with the master key itself.
+const (
+	journalMagic       = "RWFJ"
+	journalHeaderSize  = 5
+	journalFrameHeader = 8
+	journalEncrypted   = 1
+	journalKeyID       = 2
+)
+
+// journalOp identifies the mutation stored in a journal record
+type journalOp uint8
+
+const (
+	journalCreate   journalOp = iota + 1 // Path, Ino, Owner, Mode, Target (codec), Offset (level)
+	journalWrite                         // Ino, Offset, Data
+	journalTruncate                      // Ino, Offset
+	journalRemove                        // Path
+	journalMkdir                         // Path, Mode
+	journalChmod                         // Path, Mode
+	journalLink                          // Path (new link), Target (existing file)
+	journalRename                        // Path, Target
+	journalChown                         // Path, Owner, Target (group)
+)
+
+// journalRecord is a single mutation of the file system. Paths are absolute.
+// File contents are addressed by inode number, so writes through a handle stay
+// valid after the file is renamed.
+type journalRecord struct {
+	Op     journalOp
+	Mode   os.FileMode
+	Seq    uint64
+	Ino    uint64
+	Offset int64
+	Path   string
+	Target string
+	Owner  string
+	Data   []byte
+}
+
+// journalFixedSize is the size of the fixed fields of a record body
+const journalFixedSize = 1 + 4 + 8 + 8 + 8
+
+// marshal encodes the record body
+func (rec *journalRecord) marshal() []byte {
+	buf := make([]byte, 0, journalFixedSize+16+len(rec.Path)+len(rec.Target)+len(rec.Owner)+len(rec.Data))
+	buf = append(buf, byte(rec.Op))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(rec.Mode))
+	buf = binary.BigEndian.AppendUint64(buf, rec.Seq)
+	buf = binary.BigEndian.AppendUint64(buf, rec.Ino)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(rec.Offset))
+	for _, field := range [][]byte{[]byte(rec.Path), []byte(rec.Target), []byte(rec.Owner), rec.Data} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(field)))
+		buf = append(buf, field...)
+	}
+	return buf
+}
+
+// unmarshalJournalRecord decodes a record body
+func unmarshalJournalRecord(body []byte) (journalRecord, error) {
+	var rec journalRecord
+	if len(body) < journalFixedSize {
+		return rec, ErrSnapshotCorrupt
+	}
+	rec.Op = journalOp(body[0])
+	rec.Mode = os.FileMode(binary.BigEndian.Uint32(body[1:]))
+	rec.Seq = binary.BigEndian.Uint64(body[5:])
+	rec.Ino = binary.BigEndian.Uint64(body[13:])
+	rec.Offset = int64(binary.BigEndian.Uint64(body[21:]))
+	body = body[journalFixedSize:]
+
+	var fields [4][]byte
+	for i := range fields {
+		if len(body) < 4 {
+			return rec, ErrSnapshotCorrupt
+		}
+		size := binary.BigEndian.Uint32(body)
+		if uint64(len(body)-4) < uint64(size) {
+			return rec, ErrSnapshotCorrupt
+		}
+		fields[i] = body[4 : 4+size]
+		body = body[4+size:]
+	}
+	rec.Path, rec.Target, rec.Owner, rec.Data = string(fields[0]), string(fields[1]), string(fields[2]), fields[3]
+	return rec, nil
+}
+
+// journal appends records to a journal file
+type journal struct {
+	mu     sync.Mutex
+	name   string
+	file   *os.File
+	key    []byte
+	legacy bool
+	sync   bool
+	size   int64
+	seq    uint64
+}
+
+// errStaleJournal reports an encrypted journal without a key ID next to a
+// snapshot that has a journal key
+var errStaleJournal = errors.New("journal predates the journal key of the snapshot")
+
+// openJournal opens the journal at name for appending, creating it when
+// needed. Records newer than the snapshot sequence number after are passed to
+// apply; a torn tail left by a crash is cut off. Records are encrypted with
+// key unless it is nil, and every record is synced to disk if sync is set.
+//
+// If legacy is set, key is the master key and an encrypted journal without a
+// key ID is accepted. Otherwise such a journal is discarded: journal keys are
+// only introduced by writing a snapshot that contains the whole journal, so a
+// crash before the journal was reset leaves nothing in it that is not in the
+// snapshot.
+func openJournal(name string, key []byte, legacy, sync bool, after uint64, apply func(journalRecord)) (*journal, error) {
+	j := &journal{name: name, key: key, legacy: legacy, sync: sync, seq: after}
+	size, err := j.replay(after, apply)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, errStaleJournal) {
+		return j, j.reset(nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Truncate(name, size); err != nil {
+		return nil, err
+	}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	j.size = size
+	return j, nil
+}
+
+// replay reads the journal file and passes every intact record newer than
+// after to apply. It returns the size of the intact part of the file.
+func (j *journal) replay(after uint64, apply func(journalRecord)) (int64, error) {
+	file, err := os.Open(j.name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(file)
+	header := make([]byte, journalHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:4]) != journalMagic {
+		return 0, errors.New("not a journal file: " + j.name)
+	}
+	if header[4]&journalEncrypted != 0 && j.key == nil {
+		return 0, ErrKeyRequired
+	}
+	if header[4]&journalEncrypted == 0 && j.key != nil {
+		return 0, errors.New("journal is not encrypted but encryption is configured")
+	}
+	size := int64(journalHeaderSize)
+	if header[4]&journalKeyID != 0 {
+		id := make([]byte, keyIDSize)
+		if _, err := io.ReadFull(r, id); err != nil {
+			return 0, ErrSnapshotCorrupt
+		}
+		if j.legacy || !bytes.Equal(id, keyID(j.key)) {
+			return 0, errors.New("journal is encrypted with another key than the snapshot")
+		}
+		size += keyIDSize
+	} else if j.key != nil && !j.legacy {
+		return 0, errStaleJournal
+	}
+
+	frame := make([]byte, journalFrameHeader)
+	var last uint64
+	for {
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return size, nil
+		}
+		// A torn or garbage length must not allocate more than the file
+		// holds, so a body running past the end is treated as the torn tail
+		length := int64(binary.BigEndian.Uint32(frame))
+		if length > info.Size()-size-journalFrameHeader {
+			return size, nil
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return size, nil
+		}
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(frame[4:]) {
+			return size, nil
+		}
+		plain := body
+		if j.key != nil {
+			if plain, err = openData(body, j.key); err != nil {
+				return 0, ErrDecryptFailed
+			}
+		}
+		rec, err := unmarshalJournalRecord(plain)
+		if err != nil || (last != 0 && rec.Seq != last+1) {
+			return size, nil
+		}
+		if last == 0 && rec.Seq > after+1 {
+			return 0, errors.New("journal does not continue the snapshot: records are missing")
+		}
+		last = rec.Seq
+		if rec.Seq > after {
+			apply(rec)
+			j.seq = rec.Seq
+		}
+		size += int64(journalFrameHeader + len(body))
+	}
+}
+
+// append assigns the next sequence number to a record and writes it to the
+// end of the journal. It returns the new size of the journal.
+func (j *journal) append(rec journalRecord) (int64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	rec.Seq = j.seq + 1
+	body := rec.marshal()
+	if j.key != nil {
+		var err error
+		if body, err = sealData(body, j.key); err != nil {
+			return 0, err
+		}
+	}
+	frame := make([]byte, 0, journalFrameHeader+len(body))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(body)))
+	frame = binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(body))
+	frame = append(frame, body...)
+
+	n, err := j.file.Write(frame)
+	if err != nil {
+		// Cut off the partial record so later records stay readable
+		j.file.Truncate(j.size)
+		return j.size, err
+	}
+	j.size += int64(n)
+	j.seq = rec.Seq
+	if j.sync {
+		err = j.file.Sync()
+	}
+	return j.size, err
+}
+
+// mark returns the sequence number of the last record and the size of the
+// journal, which is the offset the next record will be written at
+func (j *journal) mark() (uint64, int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.seq, j.size
+}
+
+// dropBefore discards every record before offset, which must have been
+// returned by mark. Records appended after it are kept.
+func (j *journal) dropBefore(offset int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	file, err := os.Open(j.name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	tail := make([]byte, j.size-offset)
+	if _, err := file.ReadAt(tail, offset); err != nil {
+		return err
+	}
+	return j.reset(tail)
+}
+
+// rekey encrypts the records appended from now on with key. The journal must
+// be reset before any record is appended, since a journal file holds records
+// under a single key.
+func (j *journal) rekey(key []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.key, j.legacy = key, false
+}
+
+// reset atomically replaces the journal with an empty one followed by the
+// given raw records; the caller must hold the lock
+func (j *journal) reset(records []byte) error {
+	header := []byte(journalMagic + "\x00")
+	if j.key != nil {
+		header[4] = journalEncrypted
+		if !j.legacy {
+			header[4] |= journalKeyID
+			header = append(header, keyID(j.key)...)
+		}
+	}
+	err := writeFileAtomic(j.name, 0, func(w io.Writer) error {
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		_, err := w.Write(records)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := j.open(); err != nil {
+		return err
+	}
+	j.size = int64(len(header) + len(records))
+	return nil
+}
+
+// open (re)opens the journal file for appending
+func (j *journal) open() error {
+	if j.file != nil {
+		j.file.Close()
+	}
+	file, err := os.OpenFile(j.name, os.O_WRONLY|os.O_APPEND, 0644)
+	j.file = file
+	return err
+}
+
+// close closes the journal file
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
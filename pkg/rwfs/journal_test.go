@@ -0,0 +1,260 @@
+package rwfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// testConfigs are the storage settings the persistence tests run with
+var testConfigs = []struct {
+	name   string
+	config FileSystemConfig
+}{
+	{"plain", FileSystemConfig{}},
+	{"compressed", FileSystemConfig{Compression: true}},
+	{"encrypted", FileSystemConfig{Encryption: true, EncryptionKey: "secret", KeyIterations: 1000}},
+	{"compressed+encrypted", FileSystemConfig{Compression: true, Encryption: true, EncryptionKey: "secret", KeyIterations: 1000}},
+}
+
+// readFile returns the contents of the file at name
+func readFile(t *testing.T, fs FileSystem, name string) []byte {
+	t.Helper()
+	file, err := fs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// pattern returns size bytes that differ from block to block
+func pattern(size int, seed byte) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = seed + byte(i/7)
+	}
+	return data
+}
+
+// mutate applies one of every kind of journaled mutation to fs and returns
+// the expected contents of the large file it writes
+func mutate(t *testing.T, fs *LocalFileSystem) []byte {
+	t.Helper()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(fs.MkdirAll("/docs/old", 0755))
+	must(fs.Mkdir("/tmp", 0700))
+
+	small, err := fs.CreateFile("/docs/a.txt", "alice", ReadWrite)
+	must(err)
+	_, err = small.Write([]byte("hello world"))
+	must(err)
+
+	// Writes and truncations across block boundaries, addressed by inode
+	big, err := fs.CreateFile("/docs/big.bin", "alice", ReadWrite)
+	must(err)
+	want := pattern(3*blockSize+100, 1)
+	_, err = big.Write(want)
+	must(err)
+	patch := pattern(blockSize, 9)
+	_, err = big.(*FileHandle).WriteAt(patch, blockSize-50)
+	must(err)
+	copy(want[blockSize-50:], patch)
+	must(big.(*FileHandle).Truncate(2*blockSize + 10))
+	want = want[:2*blockSize+10]
+
+	must(fs.Rename("/docs/a.txt", "/docs/old/b.txt"))
+	must(fs.Link("/docs/old/b.txt", "/c.txt"))
+	must(fs.Chmod("/docs/old/b.txt", 0640))
+	must(fs.Chown("/docs/old/b.txt", "bob"))
+	must(fs.Chgrp("/docs/old/b.txt", "staff"))
+	must(fs.RemoveDir("/tmp"))
+
+	gone, err := fs.CreateFile("/gone.txt", "alice", ReadWrite)
+	must(err)
+	_, err = gone.Write([]byte("removed"))
+	must(err)
+	must(fs.RemoveFile("/gone.txt"))
+	return want
+}
+
+// checkMutated verifies the tree left by mutate
+func checkMutated(t *testing.T, fs *LocalFileSystem, big []byte) {
+	t.Helper()
+	if got := readFile(t, fs, "/docs/old/b.txt"); string(got) != "hello world" {
+		t.Errorf("b.txt = %q, want %q", got, "hello world")
+	}
+	if got := readFile(t, fs, "/docs/big.bin"); !bytes.Equal(got, big) {
+		t.Errorf("big.bin differs: %d bytes, want %d", len(got), len(big))
+	}
+	info, err := fs.Stat("/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := info.(*MemFileInfo)
+	if meta.Mode() != 0640 || meta.Owner() != "bob" || meta.Group() != "staff" {
+		t.Errorf("c.txt: mode %v, owner %q, group %q", meta.Mode(), meta.Owner(), meta.Group())
+	}
+	if fs.RootDir.Entries["c.txt"] != fs.RootDir.Dirs["docs"].Dirs["old"].Entries["b.txt"] {
+		t.Error("hard link was not restored")
+	}
+	for _, name := range []string{"/docs/a.txt", "/tmp", "/gone.txt"} {
+		if _, err := fs.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("Stat(%s) error = %v, want not exist", name, err)
+		}
+	}
+}
+
+func TestJournalReplayAfterCrash(t *testing.T) {
+	for _, test := range testConfigs {
+		t.Run(test.name, func(t *testing.T) {
+			config := test.config
+			config.Filepath = filepath.Join(t.TempDir(), "data.rwfs")
+			config.Journal = true
+			config.JournalCompactSize = -1
+
+			crashed, err := NewLocalFileSystem(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			big := mutate(t, crashed)
+			// The process dies here: nothing is saved and the journal is
+			// not closed, so the snapshot on disk holds none of the changes
+
+			reopened, err := NewLocalFileSystem(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkMutated(t, reopened, big)
+		})
+	}
+}
+
+func TestJournalTornTail(t *testing.T) {
+	config := FileSystemConfig{
+		Filepath:           filepath.Join(t.TempDir(), "data.rwfs"),
+		Journal:            true,
+		JournalCompactSize: -1,
+	}
+	crashed, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := crashed.CreateFile("/kept.txt", "", ReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash in the middle of appending leaves half a record behind
+	journal, err := os.OpenFile(config.Filepath+".journal", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := journal.Write([]byte{0, 0, 1, 0, 0xde, 0xad}); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	reopened, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, reopened, "/kept.txt"); string(got) != "kept" {
+		t.Errorf("kept.txt = %q, want %q", got, "kept")
+	}
+
+	// The torn tail is cut off, so records appended after reopening replay
+	if _, err := reopened.CreateFile("/later.txt", "", ReadWrite); err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := again.Stat("/later.txt"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJournalGarbageLength(t *testing.T) {
+	config := FileSystemConfig{
+		Filepath:           filepath.Join(t.TempDir(), "data.rwfs"),
+		Journal:            true,
+		JournalCompactSize: -1,
+	}
+	crashed, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := crashed.CreateFile("/kept.txt", "", ReadWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	// A frame whose length claims far more than the file holds
+	journal, err := os.OpenFile(config.Filepath+".journal", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := journal.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0xde, 0xad}); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	reopened, err := NewLocalFileSystem(config)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<20 {
+		t.Errorf("replay allocated %d bytes for a garbage frame length", allocated)
+	}
+	if _, err := reopened.Stat("/kept.txt"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	config := FileSystemConfig{
+		Filepath:           filepath.Join(t.TempDir(), "data.rwfs"),
+		Journal:            true,
+		JournalCompactSize: -1,
+	}
+	fs, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := mutate(t, fs)
+	if err := fs.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(config.Filepath + ".journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != journalHeaderSize {
+		t.Errorf("journal size after compaction = %d, want %d", info.Size(), journalHeaderSize)
+	}
+
+	reopened, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMutated(t, reopened, big)
+}
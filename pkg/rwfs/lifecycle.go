@@ -0,0 +1,165 @@
+package rwfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// start installs the mutation recorder when a Filepath is configured, so that
+// Flush and Close know about unsaved changes, and starts the background
+// goroutine that performs autosaves and journal compactions, if any of them
+// is configured
+func (fs *LocalFileSystem) start(config FileSystemConfig) error {
+	autosave := config.AutosaveInterval > 0 || config.AutosaveBytes > 0
+	if config.Filepath == "" {
+		if autosave {
+			return errors.New("autosave requires a Filepath")
+		}
+		return nil
+	}
+
+	fs.autosaveBytes = config.AutosaveBytes
+	fs.MemFileSystem.recorder = fs.recordMutation
+	if !autosave && fs.journal == nil {
+		return nil
+	}
+	fs.flushRequest = make(chan struct{}, 1)
+	fs.stop = make(chan struct{})
+	fs.done = make(chan struct{})
+	go fs.run(config.AutosaveInterval)
+	return nil
+}
+
+// recordMutation appends a mutation to the journal, if enabled, and marks the
+// file system dirty. It requests a flush once the journal or the amount of
+// unsaved data reaches its configured size.
+func (fs *LocalFileSystem) recordMutation(rec journalRecord) error {
+	var err error
+	if fs.journal != nil {
+		var size int64
+		size, err = fs.journal.append(rec)
+		if err == nil && fs.compactSize > 0 && size >= fs.compactSize {
+			fs.requestFlush()
+		}
+	}
+	fs.dirty.Store(true)
+	if fs.autosaveBytes > 0 && fs.dirtyBytes.Add(int64(len(rec.Data))) >= fs.autosaveBytes {
+		fs.requestFlush()
+	}
+	return err
+}
+
+// requestFlush asks the background goroutine to flush without waiting for it
+func (fs *LocalFileSystem) requestFlush() {
+	select {
+	case fs.flushRequest <- struct{}{}:
+	default:
+		// A flush is already pending
+	}
+}
+
+// run flushes the file system whenever the autosave interval passes with
+// unsaved changes or a flush is requested, until Close is called
+func (fs *LocalFileSystem) run(interval time.Duration) {
+	defer close(fs.done)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-fs.stop:
+			return
+		case <-tick:
+		case <-fs.flushRequest:
+		}
+		// A failed flush leaves the file system dirty and is retried later
+		if err := fs.Flush(); err != nil {
+			fs.setErr(err)
+		}
+	}
+}
+
+// Flush writes unsaved changes to the configured snapshot file and, when the
+// journal is enabled, compacts it. It does nothing if there are no changes.
+func (fs *LocalFileSystem) Flush() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.snapshotPath == "" {
+		return errors.New("no Filepath configured")
+	}
+	if fs.closed.Load() {
+		return os.ErrClosed
+	}
+	if !fs.dirty.Load() {
+		return nil
+	}
+	return fs.persist()
+}
+
+// Err returns the error of the last failed background autosave or journal
+// compaction, or nil if there was none
+func (fs *LocalFileSystem) Err() error {
+	fs.errMu.Lock()
+	defer fs.errMu.Unlock()
+	return fs.err
+}
+
+func (fs *LocalFileSystem) setErr(err error) {
+	fs.errMu.Lock()
+	defer fs.errMu.Unlock()
+	fs.err = err
+}
+
+// Close stops the background goroutines, writes unsaved changes to the
+// configured snapshot file, if any, and closes the journal. Mutations fail
+// with os.ErrClosed from the moment Close is called, while reads go on.
+//
+// If ctx is done before a running background save has finished, or the
+// unsaved changes cannot be written, Close returns the error and keeps the
+// changes in memory and the journal open, so that Close can be called again.
+// Once it succeeded, further calls return os.ErrClosed.
+func (fs *LocalFileSystem) Close(ctx context.Context) error {
+	fs.closeMu.Lock()
+	defer fs.closeMu.Unlock()
+
+	if fs.closed.Load() {
+		return os.ErrClosed
+	}
+	// Wait for mutations in progress, which are then part of the final flush
+	fs.MemFileSystem.mu.Lock()
+	fs.MemFileSystem.closed = true
+	fs.MemFileSystem.mu.Unlock()
+
+	if fs.stop != nil {
+		select {
+		case <-fs.stop:
+			// Stopped by an earlier call that did not finish
+		default:
+			close(fs.stop)
+		}
+		select {
+		case <-fs.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var err error
+	if fs.snapshotPath != "" {
+		if err := fs.Flush(); err != nil {
+			return err
+		}
+		if fs.journal != nil {
+			err = fs.journal.close()
+		}
+	}
+	fs.closed.Store(true)
+	return err
+}
@@ -0,0 +1,201 @@
+package rwfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFlush(t *testing.T) {
+	config := FileSystemConfig{Filepath: filepath.Join(t.TempDir(), "data.rwfs")}
+	fs, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(config.Filepath); !os.IsNotExist(err) {
+		t.Errorf("Flush without changes wrote a snapshot: Stat error = %v", err)
+	}
+
+	big := mutate(t, fs)
+	if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMutated(t, reopened, big)
+
+	memory, err := NewLocalFileSystem(FileSystemConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memory.Flush(); err == nil {
+		t.Error("Flush succeeded without a Filepath")
+	}
+}
+
+func TestAutosave(t *testing.T) {
+	config := FileSystemConfig{Filepath: filepath.Join(t.TempDir(), "data.rwfs"), AutosaveBytes: 10}
+	fs, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close(context.Background())
+	file, err := fs.CreateFile("/a.txt", "", ReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("more than ten bytes")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fs.dirty.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("no autosave after AutosaveBytes were written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := fs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	fs.mu.Lock() // wait for the autosave to finish
+	fs.mu.Unlock()
+	reopened, err := NewLocalFileSystem(FileSystemConfig{Filepath: config.Filepath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, reopened, "/a.txt"); string(got) != "more than ten bytes" {
+		t.Errorf("a.txt = %q after autosave", got)
+	}
+}
+
+func TestClose(t *testing.T) {
+	for _, journal := range []bool{false, true} {
+		config := FileSystemConfig{
+			Filepath:         filepath.Join(t.TempDir(), "data.rwfs"),
+			Journal:          journal,
+			AutosaveInterval: time.Hour,
+		}
+		fs, err := NewLocalFileSystem(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		big := mutate(t, fs)
+		file, err := fs.OpenFileFlags("/docs/old/b.txt", os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Close(context.Background()); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("second Close: error = %v, want os.ErrClosed", err)
+		}
+		if err := fs.Flush(); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("Flush after Close: error = %v, want os.ErrClosed", err)
+		}
+
+		// Reads go on, mutations fail
+		checkMutated(t, fs, big)
+		checkClosed(t, fs, file)
+
+		reopened, err := NewLocalFileSystem(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMutated(t, reopened, big)
+		reopened.Close(context.Background())
+	}
+}
+
+// checkClosed verifies that every kind of mutation fails on a closed file
+// system; file is a handle opened for writing before it was closed
+func checkClosed(t *testing.T, fs *LocalFileSystem, file File) {
+	t.Helper()
+	handle := file.(*FileHandle)
+	for op, err := range map[string]error{
+		"CreateFile": openErr(fs.CreateFile("/new.txt", "", ReadWrite)),
+		"Mkdir":      fs.Mkdir("/new", 0755),
+		"MkdirAll":   fs.MkdirAll("/new/dir", 0755),
+		"Rename":     fs.Rename("/docs/old/b.txt", "/b.txt"),
+		"Remove":     fs.Remove("/c.txt"),
+		"RemoveAll":  fs.RemoveAll("/docs"),
+		"Chmod":      fs.Chmod("/c.txt", 0600),
+		"Chown":      fs.Chown("/c.txt", "eve"),
+		"Link":       fs.Link("/c.txt", "/d.txt"),
+		"Write":      writeErr(handle.Write([]byte("lost"))),
+		"WriteAt":    writeErr(handle.WriteAt([]byte("lost"), 0)),
+		"Truncate":   handle.Truncate(0),
+		"O_TRUNC":    openErr(fs.OpenFileFlags("/c.txt", os.O_RDWR|os.O_TRUNC, 0)),
+	} {
+		if !errors.Is(err, os.ErrClosed) {
+			t.Errorf("%s after Close: error = %v, want os.ErrClosed", op, err)
+		}
+	}
+	if got := readFile(t, fs, "/c.txt"); string(got) != "hello world" {
+		t.Errorf("c.txt = %q after mutations on the closed file system", got)
+	}
+}
+
+func writeErr(_ int, err error) error {
+	return err
+}
+
+func TestCloseRetry(t *testing.T) {
+	config := FileSystemConfig{
+		Filepath:           filepath.Join(t.TempDir(), "data.rwfs"),
+		Journal:            true,
+		JournalCompactSize: -1,
+		AutosaveBytes:      1,
+	}
+	fs, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold up the background save that the write below requests, so that
+	// Close runs out of time waiting for it
+	fs.mu.Lock()
+	file, err := fs.CreateFile("/a.txt", "", ReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("unsaved")); err != nil {
+		t.Fatal(err)
+	}
+	for len(fs.flushRequest) > 0 {
+		// Wait until the background goroutine picked up the request
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := fs.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Close: error = %v, want context.DeadlineExceeded", err)
+	}
+	if _, err := fs.CreateFile("/b.txt", "", ReadWrite); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("CreateFile while closing: error = %v, want os.ErrClosed", err)
+	}
+	fs.mu.Unlock()
+
+	if err := fs.Close(context.Background()); err != nil {
+		t.Fatalf("retried Close: %v", err)
+	}
+	if fs.journal.file != nil {
+		t.Error("journal was not closed")
+	}
+	reopened, err := NewLocalFileSystem(FileSystemConfig{Filepath: config.Filepath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, reopened, "/a.txt"); string(got) != "unsaved" {
+		t.Errorf("a.txt = %q, want %q", got, "unsaved")
+	}
+}
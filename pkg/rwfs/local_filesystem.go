@@ -1,10 +1,18 @@
 package rwfs
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 // LocalFileSystem extends MemFileSystem with persistent storage capabilities
@@ -12,101 +20,641 @@ type LocalFileSystem struct {
 	*MemFileSystem
 	mu            RWMutex
 	compression   bool
+	codec         Codec
 	compressLevel int
 	encryption    bool
 	encryptionKey string
+	rawKey        []byte
+	backups       int
+	snapshotPath  string
+	journal       *journal
+	journalSeq    uint64
+	journalKey    []byte
+	compactSize   int64
+	autosaveBytes int64
+	dirty         atomic.Bool
+	dirtyBytes    atomic.Int64
+	flushRequest  chan struct{}
+	stop          chan struct{}
+	done          chan struct{}
+	closeMu       sync.Mutex
+	closed        atomic.Bool
+	errMu         sync.Mutex
+	err           error
 	RootPath      string
 }
 
+// defaultJournalCompactSize is the journal size that triggers a background
+// compaction when FileSystemConfig.JournalCompactSize is zero
+const defaultJournalCompactSize = 8 << 20
+
 // NewLocalFileSystem creates a new LocalFileSystem using the provided configuration
 func NewLocalFileSystem(config FileSystemConfig) (*LocalFileSystem, error) {
+	if config.EncryptionRawKey != nil && len(config.EncryptionRawKey) != keySize {
+		return nil, ErrInvalidKey
+	}
 	fs := &LocalFileSystem{
-		MemFileSystem: NewMemFileSystem(config),
+		MemFileSystem: newMemFileSystem(config),
 		compression:   config.Compression,
 		compressLevel: config.CompressLevel,
 		encryption:    config.Encryption,
 		encryptionKey: config.EncryptionKey,
+		rawKey:        config.EncryptionRawKey,
+		backups:       config.BackupGenerations,
+		snapshotPath:  config.Filepath,
+	}
+	if config.Compression {
+		codec, err := LookupCodec(config.Codec)
+		if err != nil {
+			return nil, err
+		}
+		fs.codec = codec
 	}
 	if config.Filepath != "" {
 		if err := fs.LoadFromFile(config.Filepath); err != nil {
 			return nil, err
 		}
 	}
+	if fs.MemFileSystem.key == nil && fs.hasKey() {
+		key, err := newMasterKey(config)
+		if err != nil {
+			return nil, err
+		}
+		fs.MemFileSystem.key = key
+	}
+	if config.Journal {
+		if err := fs.openJournal(config); err != nil {
+			return nil, err
+		}
+	}
+	if err := fs.start(config); err != nil {
+		return nil, err
+	}
 	return fs, nil
 }
 
-// SaveToFile saves the in-memory file system to a binary file with optional compression and encryption
-func (fs *LocalFileSystem) SaveToFile(filepath string) error {
+// openJournal replays the journal next to the snapshot file over the loaded
+// tree and starts recording every mutation to it
+func (fs *LocalFileSystem) openJournal(config FileSystemConfig) error {
+	if config.Filepath == "" {
+		return errors.New("journal requires a Filepath")
+	}
+	name := config.Filepath + ".journal"
+	key := fs.journalKey
+	var legacy bool
+	if fs.encryption && key == nil {
+		if _, err := os.Stat(name); err == nil {
+			// Journals next to snapshots written before journal keys
+			// existed are encrypted with the master key
+			key, legacy = fs.MemFileSystem.key.key, true
+		} else {
+			// The journal key can only be read from the snapshot, so the
+			// snapshot has to be written before the first record
+			if key, err = newJournalKey(); err != nil {
+				return err
+			}
+			fs.journalKey = key
+			if err := fs.persist(); err != nil {
+				return err
+			}
+		}
+	}
+
+	fs.MemFileSystem.mu.Lock()
+	replayer := newReplayer(fs.MemFileSystem)
+	j, err := openJournal(name, key, legacy, config.JournalSync, fs.journalSeq, replayer.apply)
+	fs.MemFileSystem.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	fs.journal = j
+	fs.compactSize = config.JournalCompactSize
+	if fs.compactSize == 0 {
+		fs.compactSize = defaultJournalCompactSize
+	}
+	if legacy {
+		// Move to a journal key. The snapshot holds every replayed record,
+		// so the journal starts over empty under the new key.
+		if fs.journalKey, err = newJournalKey(); err != nil {
+			return err
+		}
+		j.rekey(fs.journalKey)
+		return fs.persist()
+	}
+	return nil
+}
+
+// newJournalKey creates a random journal key
+func newJournalKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	_, err := io.ReadFull(rand.Reader, key)
+	return key, err
+}
+
+// Compact writes the current tree as a new snapshot to the configured file
+// and drops the journal records it contains. It runs in the background once
+// the journal reaches FileSystemConfig.JournalCompactSize.
+func (fs *LocalFileSystem) Compact() error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	var buf bytes.Buffer
-	encoder := gob.NewEncoder(&buf)
-	if err := encoder.Encode(fs.Files); err != nil {
+	return fs.compact()
+}
+
+// compact implements Compact; the caller must hold the lock
+func (fs *LocalFileSystem) compact() error {
+	if fs.journal == nil {
+		return errors.New("journal is not enabled")
+	}
+	if fs.closed.Load() {
+		return os.ErrClosed
+	}
+	return fs.persist()
+}
+
+// persist writes the current tree to the configured snapshot file and drops
+// the journal records it contains; the caller must hold the lock. The tree is
+// copied under its read lock and the copy is written without holding any
+// lock, so neither readers nor writers wait for the snapshot to be
+// compressed, encrypted and synced. The copy shares file contents with the
+// tree, and only files written while the snapshot is saved are duplicated.
+func (fs *LocalFileSystem) persist() error {
+	_, err := fs.save()
+	return err
+}
+
+// save implements persist. It also reports whether the snapshot file was
+// replaced, which may be the case even if an error is returned.
+func (fs *LocalFileSystem) save() (bool, error) {
+	fs.dirty.Store(false)
+	fs.dirtyBytes.Store(0)
+	tree, err := fs.copyTree()
+	if err != nil {
+		fs.dirty.Store(true)
+		return false, err
+	}
+	defer releaseTree(tree.files)
+
+	renamed, err := replaceFile(fs.snapshotPath, fs.backups, func(w io.Writer) error {
+		return fs.writeSnapshot(w, tree)
+	})
+	if err != nil {
+		fs.dirty.Store(true)
+		return renamed, err
+	}
+	if fs.journal != nil {
+		return true, fs.journal.dropBefore(tree.offset)
+	}
+	return true, nil
+}
+
+// treeCopy is a copy of the directory tree taken to write a snapshot, along
+// with the keys and the journal position it has to be written with
+type treeCopy struct {
+	root       *MemDirectory
+	files      map[*MemFile]*MemFile
+	key        *masterKey
+	journalKey []byte
+	seq        uint64 // last journal record contained in the copy
+	offset     int64  // journal offset after that record
+}
+
+// copyTree copies the tree under its read lock; the caller must hold the lock
+// of the file system, at least for reading. Mutations of the tree are blocked
+// while it is copied, so the copy contains exactly the structural records up
+// to seq. Writes to file contents may still land after seq and be in the copy
+// as well, which is harmless since replaying them again gives the same result.
+// releaseTree must be called on the files of the copy once it is written.
+func (fs *LocalFileSystem) copyTree() (*treeCopy, error) {
+	fs.MemFileSystem.mu.RLock()
+	defer fs.MemFileSystem.mu.RUnlock()
+
+	tree := &treeCopy{key: fs.MemFileSystem.key, journalKey: fs.journalKey}
+	if fs.journal != nil {
+		tree.seq, tree.offset = fs.journal.mark()
+	}
+	var err error
+	if tree.root, tree.files, err = cloneTree(fs.RootDir); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// SaveToFile saves the whole directory tree to a snapshot file with optional
+// compression and encryption. The settings used are recorded in the file
+// header; see format.go for the layout.
+//
+// The snapshot is written to a temporary file, synced and then renamed over
+// the target, so a crash or a full disk never destroys the previous snapshot.
+// With FileSystemConfig.BackupGenerations set, the replaced snapshots are kept
+// as name.1, name.2 and so on. Saving to the configured file while the journal
+// is enabled compacts the journal.
+func (fs *LocalFileSystem) SaveToFile(name string) error {
+	if fs.journal != nil && name == fs.snapshotPath {
+		return fs.Compact()
+	}
+	return writeFileAtomic(name, fs.backups, fs.SaveTo)
+}
+
+// SaveTo streams a snapshot of the whole directory tree to w. The tree is
+// encoded, compressed and encrypted on the fly, so the snapshot is never held
+// in memory as a whole. It is copied first, like for persist, and the copy
+// is streamed without holding any lock, so a slow writer blocks neither
+// readers nor writers of the file system.
+func (fs *LocalFileSystem) SaveTo(w io.Writer) error {
+	fs.mu.RLock()
+	tree, err := fs.copyTree()
+	fs.mu.RUnlock()
+	if err != nil {
 		return err
 	}
+	defer releaseTree(tree.files)
+
+	return fs.writeSnapshot(w, tree)
+}
 
-	data := buf.Bytes()
+// writeSnapshot streams a snapshot of a copy of the tree to w
+func (fs *LocalFileSystem) writeSnapshot(w io.Writer, tree *treeCopy) error {
+	bw := bufio.NewWriter(w)
+	header := snapshotHeader{Version: snapshotVersion, Extensions: make(map[uint8][]byte)}
+	if tree.seq != 0 {
+		header.Extensions[extJournalSeq] = binary.BigEndian.AppendUint64(nil, tree.seq)
+	}
+	id := make([]byte, snapshotIDSize)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return err
+	}
+	header.Extensions[extSnapshotID] = id
 	if fs.compression {
+		header.Flags |= flagCompressed
+		header.Extensions[extCodec] = []byte(fs.codec.Name())
+	}
+	key := tree.key
+	if fs.encryption {
+		if key == nil {
+			return fs.keyErr
+		}
+		header.Flags |= flagEncrypted
+		if key.salt != nil {
+			header.Extensions[extKDF] = binary.BigEndian.AppendUint32(bytes.Clone(key.salt), uint32(key.iterations))
+		}
+		header.Extensions[extKeyID] = keyID(key.key)
+		if tree.journalKey != nil {
+			wrapped, err := sealData(tree.journalKey, key.key)
+			if err != nil {
+				return err
+			}
+			header.Extensions[extJournalKey] = wrapped
+		}
+	}
+	checksum := newChecksumWriter(bw)
+	if err := writeSnapshotHeader(checksum, header); err != nil {
+		return err
+	}
+
+	var payload io.Writer = checksum
+	var encrypter *streamWriter
+	if fs.encryption {
 		var err error
-		data, err = CompressData(data, fs.compressLevel)
+		encrypter, err = newStreamWriter(payload, key.key)
 		if err != nil {
 			return err
 		}
+		payload = encrypter
 	}
-
-	if fs.encryption {
+	var compressor io.WriteCloser
+	if fs.compression {
 		var err error
-		data, err = EncryptData(data, fs.encryptionKey)
+		compressor, err = fs.codec.NewWriter(payload, compressLevel(fs.compressLevel))
 		if err != nil {
 			return err
 		}
+		payload = compressor
+	}
+
+	if err := encodeTree(gob.NewEncoder(payload), tree.root, id); err != nil {
+		return err
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return err
+		}
+	}
+	if encrypter != nil {
+		if err := encrypter.Close(); err != nil {
+			return err
+		}
+	}
+	if err := checksum.writeTrailer(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// LoadFromFile replaces the directory tree with the one stored in a snapshot
+// file. Compression and encryption are detected from the file header, so only
+// the encryption key has to match the configuration. If the snapshot cannot be
+// read because it is missing or damaged and backup generations are
+// configured, the newest valid backup is loaded instead. Errors about the key
+// or the snapshot policy, such as a KeyMismatchError, are returned as they
+// are: they apply to the backups as well, and a stale backup loaded in their
+// place would be saved over the current snapshot.
+func (fs *LocalFileSystem) LoadFromFile(name string) error {
+	err := fs.loadFile(name)
+	if err == nil {
+		return nil
+	}
+	if os.IsNotExist(err) || damaged(err) {
+		for i := 1; i <= fs.backups; i++ {
+			if fs.loadFile(backupName(name, i)) == nil {
+				return nil
+			}
+		}
+	}
+	if os.IsNotExist(err) {
+		return nil // It's okay if the file doesn't exist
+	}
+	return err
+}
+
+// damaged reports whether a snapshot failed to load because its contents are
+// corrupt, rather than because of the configured key or policy
+func damaged(err error) bool {
+	var mismatch *KeyMismatchError
+	if errors.As(err, &mismatch) {
+		return false
+	}
+	return errors.Is(err, ErrSnapshotCorrupt) || errors.Is(err, ErrSnapshotChecksum) || errors.Is(err, ErrDecryptFailed)
+}
+
+// corruptPayload marks err, a failure to decompress or decode the payload of a
+// snapshot, as corruption. Decryption failures already tell so, and unknown
+// codecs are a matter of configuration, so they are returned as they are.
+func corruptPayload(err error) error {
+	if err == nil || errors.Is(err, ErrDecryptFailed) || errors.Is(err, ErrUnknownCodec) {
+		return err
 	}
+	return &payloadError{err: err}
+}
 
-	file, err := os.Create(filepath)
+// loadFile loads a single snapshot file
+func (fs *LocalFileSystem) loadFile(name string) error {
+	file, err := os.Open(name)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	_, err = file.Write(data)
-	return err
+	return fs.LoadFrom(file)
 }
 
-// LoadFromFile loads the in-memory file system from a binary file with optional decompression and decryption
-func (fs *LocalFileSystem) LoadFromFile(filepath string) error {
+// LoadFrom replaces the directory tree with a snapshot streamed from r.
+// Decryption, decompression and decoding happen on the fly, and the tree is
+// only installed once the whole stream has been verified. While the journal
+// is enabled, the loaded tree is written to the configured file as the new
+// base of the journal.
+func (fs *LocalFileSystem) LoadFrom(r io.Reader) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	file, err := os.Open(filepath)
+	if err := fs.loadFrom(r); err != nil {
+		return err
+	}
+	if fs.journal != nil {
+		return fs.persist()
+	}
+	return nil
+}
+
+// loadFrom implements LoadFrom; the caller must hold the lock
+func (fs *LocalFileSystem) loadFrom(r io.Reader) error {
+	br := bufio.NewReader(r)
+	if !isSnapshot(br) {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		return fs.loadLegacy(data)
+	}
+
+	header, err := readSnapshotHeader(br)
+	if err != nil {
+		return err
+	}
+	checksum := newChecksumReader(br, header)
+	key, err := fs.loadKey(header, header.Flags&flagEncrypted != 0)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // It's okay if the file doesn't exist
+		// A damaged header can look like a different key
+		if verr := checksum.verifyHeader(); verr != nil {
+			return verr
 		}
 		return err
 	}
-	defer file.Close()
+	if header.Version == 1 {
+		return fs.loadV1(br, header, key)
+	}
+
+	var payload io.Reader = checksum
+	if header.Flags&flagEncrypted != 0 {
+		if payload, err = newStreamReader(payload, key.key); err != nil {
+			return err
+		}
+	}
+	if header.Flags&flagCompressed != 0 {
+		codec, err := header.codec()
+		if err != nil {
+			if verr := checksum.verifyHeader(); verr != nil {
+				return verr
+			}
+			return err
+		}
+		decompressor, err := codec.NewReader(payload)
+		if err != nil {
+			// Prefer reporting corruption detected by the checksum
+			if verr := checksum.verify(); verr != nil {
+				return verr
+			}
+			return corruptPayload(err)
+		}
+		defer decompressor.Close()
+		payload = decompressor
+	}
+
+	root, files, err := decodeTree(gob.NewDecoder(payload))
+	if err == nil {
+		// Consume the rest of the stream so that the final encryption
+		// segment and the compression trailer are verified as well
+		_, err = io.Copy(io.Discard, payload)
+	}
+	if verr := checksum.verify(); verr != nil {
+		return verr
+	}
+	if err != nil {
+		return corruptPayload(err)
+	}
+	var binding *treeBinding
+	if header.Flags&flagEncrypted != 0 && header.snapshotID() != nil {
+		binding = &treeBinding{id: header.snapshotID(), files: files}
+	}
+	if err := fs.replaceTree(root, key, binding); err != nil {
+		return err
+	}
+	fs.journalSeq = header.journalSeq()
+	fs.adoptJournalKey(header, key)
+	return nil
+}
+
+// loadKey returns the master key to load a snapshot with: the key it was
+// encrypted with, or a fresh key if it is not encrypted but the file system
+// is and has no key yet. An encrypted file system refuses snapshots that are
+// not encrypted unless MigrateSnapshots is set. The key of the file system is
+// reused when the snapshot was written with it, which saves deriving it again.
+func (fs *LocalFileSystem) loadKey(header snapshotHeader, encrypted bool) (*masterKey, error) {
+	current := fs.MemFileSystem.key
+	if !encrypted {
+		if fs.encryption && !fs.Config.MigrateSnapshots {
+			return nil, ErrNotEncrypted
+		}
+		if fs.encryption && current == nil && fs.hasKey() {
+			return newMasterKey(fs.Config)
+		}
+		return nil, nil
+	}
+	if !fs.hasKey() {
+		return nil, ErrKeyRequired
+	}
+	key, err := fs.snapshotKey(header, current)
+	if err != nil {
+		return nil, err
+	}
+	if id := header.Extensions[extKeyID]; id != nil && !bytes.Equal(id, keyID(key.key)) {
+		return nil, &KeyMismatchError{KeyID: hex.EncodeToString(id)}
+	}
+	return key, nil
+}
+
+// snapshotKey derives the master key for an encrypted snapshot from the
+// configured key
+func (fs *LocalFileSystem) snapshotKey(header snapshotHeader, current *masterKey) (*masterKey, error) {
+	if fs.rawKey != nil {
+		if current != nil {
+			return current, nil
+		}
+		return rawMasterKey(fs.rawKey)
+	}
+	salt, iterations, ok := header.kdf()
+	if !ok {
+		return &masterKey{key: deriveKey(fs.encryptionKey)}, nil
+	}
+	if iterations < 1 || iterations > maxKeyIterations {
+		return nil, ErrSnapshotCorrupt
+	}
+	if current != nil && bytes.Equal(current.salt, salt) && current.iterations == iterations {
+		return current, nil
+	}
+	return passphraseKey(fs.encryptionKey, bytes.Clone(salt), iterations), nil
+}
 
-	data, err := io.ReadAll(file)
+// adoptJournalKey takes over the journal key of a loaded snapshot. The key of
+// an open journal is kept, since its records are encrypted with it.
+func (fs *LocalFileSystem) adoptJournalKey(header snapshotHeader, key *masterKey) {
+	if fs.journal != nil {
+		return
+	}
+	fs.journalKey = nil
+	if wrapped := header.Extensions[extJournalKey]; wrapped != nil && key != nil {
+		if journalKey, err := openData(wrapped, key.key); err == nil && len(journalKey) == keySize {
+			fs.journalKey = journalKey
+		}
+	}
+}
+
+// hasKey reports whether a passphrase or a raw key is configured
+func (fs *LocalFileSystem) hasKey() bool {
+	return fs.encryptionKey != "" || fs.rawKey != nil
+}
+
+// loadV1 loads a version 1 snapshot, whose payload was encrypted with a
+// single seal and has to be read as a whole
+func (fs *LocalFileSystem) loadV1(r io.Reader, header snapshotHeader, key *masterKey) error {
+	data, err := io.ReadAll(r)
 	if err != nil {
 		return err
 	}
+	if len(data) < sha256.Size {
+		return ErrSnapshotCorrupt
+	}
+	data, trailer := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if checksum := sha256.Sum256(data); !bytes.Equal(checksum[:], trailer) {
+		return ErrSnapshotChecksum
+	}
 
+	if header.Flags&flagEncrypted != 0 {
+		data, err = openData(data, key.key)
+		if err != nil {
+			return ErrDecryptFailed
+		}
+	}
+
+	if header.Flags&flagCompressed != 0 {
+		data, err = DecompressData(data)
+		if err != nil {
+			return corruptPayload(err)
+		}
+	}
+
+	root, _, err := decodeTree(gob.NewDecoder(bytes.NewReader(data)))
+	if err != nil {
+		return corruptPayload(err)
+	}
+	if err := fs.replaceTree(root, key, nil); err != nil {
+		return err
+	}
+	fs.journalSeq = header.journalSeq()
+	fs.adoptJournalKey(header, key)
+	return nil
+}
+
+// loadLegacy loads a snapshot written before the container format existed.
+// Such files carry no header, so the configured compression and encryption
+// settings are used to read them.
+func (fs *LocalFileSystem) loadLegacy(data []byte) error {
+	key, err := fs.loadKey(snapshotHeader{}, fs.encryption)
+	if err != nil {
+		return err
+	}
 	if fs.encryption {
-		data, err = DecryptData(data, fs.encryptionKey)
+		data, err = openData(data, key.key)
 		if err != nil {
-			return err
+			return ErrDecryptFailed
 		}
 	}
 
 	if fs.compression {
 		data, err = DecompressData(data)
 		if err != nil {
-			return err
+			return corruptPayload(err)
 		}
 	}
 
-	buf := bytes.NewBuffer(data)
-	decoder := gob.NewDecoder(buf)
-	return decoder.Decode(&fs.Files)
+	root, _, err := decodeTree(gob.NewDecoder(bytes.NewReader(data)))
+	if err != nil {
+		// The oldest snapshots only hold a flat map of files
+		var files map[string]*MemFile
+		if gob.NewDecoder(bytes.NewReader(data)).Decode(&files) != nil {
+			return corruptPayload(err)
+		}
+		root = NewMemDirectory("/", Exec&^defaultUmask)
+		for name, file := range files {
+			file.refCount = 1
+			root.Entries[name] = file
+		}
+	}
+	if err := fs.replaceTree(root, key, nil); err != nil {
+		return err
+	}
+	fs.journalSeq = 0
+	fs.adoptJournalKey(snapshotHeader{}, key)
+	return nil
 }
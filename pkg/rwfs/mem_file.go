@@ -1,7 +1,6 @@
 package rwfs
 
 import (
-	"bytes"
 	"errors"
 	"io"
 	"os"
@@ -10,79 +9,64 @@ import (
 
 // MemFile represents a file in the memory file system
 type MemFile struct {
-	Name        string
-	Data        *bytes.Buffer
-	mu          RWMutex
-	size        int64
-	modTime     time.Time
-	accessTime  time.Time
-	changeTime  time.Time
-	owner       string
-	position    int64
-	closed      bool
-	permissions FilePermission
-	refCount    int
-	Config      FileSystemConfig
-	Cache       *FileCache
-}
-
-// NewMemFile creates a new memory file
-func NewMemFile(name, owner string, permissions FilePermission) *MemFile {
+	Name       string
+	data       fileData
+	mu         RWMutex
+	modTime    time.Time
+	accessTime time.Time
+	changeTime time.Time
+	owner      string
+	group      string
+	position   int64
+	closed     bool
+	mode       os.FileMode
+	refCount   int
+	ino        uint64
+	Cache      *FileCache
+}
+
+// NewMemFile creates a new memory file with the given permission bits
+func NewMemFile(name, owner string, mode os.FileMode) *MemFile {
 	now := time.Now()
 	return &MemFile{
-		Name:        name,
-		Data:        new(bytes.Buffer),
-		modTime:     now,
-		accessTime:  now,
-		changeTime:  now,
-		owner:       owner,
-		permissions: permissions,
-		refCount:    1,
+		Name:       name,
+		modTime:    now,
+		accessTime: now,
+		changeTime: now,
+		owner:      owner,
+		mode:       mode & modeMask,
+		refCount:   1,
 	}
 }
 
 // MemFile methods
 
-// Read data from the memory buffer
+// Read reads data starting at the current position and advances it
 func (f *MemFile) Read(p []byte) (int, error) {
-	f.mu.RLock()
-	defer f.mu.RUnlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.closed {
 		return 0, os.ErrClosed
 	}
-	if f.Config.Compression {
-		_, _ = DecompressData(f.Data.Bytes())
-	}
-	if f.Config.Encryption {
-		_, _ = DecryptData(f.Data.Bytes(), f.Config.EncryptionKey)
-	}
-	n, err := f.Data.Read(p)
-	if err == nil {
-		f.accessTime = time.Now()
+	if f.position >= f.data.len() {
+		return 0, io.EOF
 	}
+	n, err := f.data.readAt(p, f.position)
+	f.position += int64(n)
+	f.accessTime = time.Now()
 	return n, err
 }
 
-// Write data to the memory buffer
+// Write writes data at the current position and advances it, overwriting
+// existing content and growing the file as needed
 func (f *MemFile) Write(p []byte) (int, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	if f.closed {
 		return 0, os.ErrClosed
 	}
-	f.Data.Reset()
-	if f.Config.Compression {
-		_, _ = CompressData(f.Data.Bytes(), f.Config.CompressLevel)
-	}
-	if f.Config.Encryption {
-		_, _ = EncryptData(f.Data.Bytes(), f.Config.EncryptionKey)
-	}
-	n, err := f.Data.Write(p)
-	if err == nil {
-		f.size += int64(n)
-		f.modTime = time.Now()
-		f.changeTime = time.Now()
-	}
+	n, err := f.writeAt(p, f.position)
+	f.position += int64(n)
 	// Cache the file after write
 	if f.Cache != nil {
 		f.Cache.Put(f.Name, f, true)
@@ -90,6 +74,132 @@ func (f *MemFile) Write(p []byte) (int, error) {
 	return n, err
 }
 
+// ReadAt reads len(p) bytes starting at offset off. It does not consume the
+// data and does not move the current position.
+func (f *MemFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.mu.RLock()
+	if off >= f.data.len() {
+		f.mu.RUnlock()
+		return 0, io.EOF
+	}
+	n, err := f.data.readAt(p, off)
+	f.mu.RUnlock()
+
+	f.mu.Lock()
+	f.accessTime = time.Now()
+	f.mu.Unlock()
+	if err == nil && n < len(p) {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// WriteAt writes p starting at offset off without moving the current
+// position. Writing past the end of the file fills the gap with zeros.
+func (f *MemFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAt(p, off)
+}
+
+// Append writes p at the end of the file
+func (f *MemFile) Append(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAt(p, f.data.len())
+}
+
+// writeAt writes p at offset off; the caller must hold the write lock
+func (f *MemFile) writeAt(p []byte, off int64) (int, error) {
+	n, err := f.data.writeAt(p, off)
+	f.modTime = time.Now()
+	f.changeTime = f.modTime
+	return n, err
+}
+
+// Truncate changes the size of the file. Extending the file fills the new
+// space with zeros.
+func (f *MemFile) Truncate(size int64) error {
+	if size < 0 {
+		return errors.New("negative size")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.truncate(size)
+}
+
+// truncate changes the size of the file; the caller must hold the write lock
+func (f *MemFile) truncate(size int64) error {
+	err := f.data.truncate(size)
+	f.modTime = time.Now()
+	f.changeTime = f.modTime
+	return err
+}
+
+// clone returns a copy of the file whose contents are independent of the
+// original, though plain contents are shared until written; see
+// fileData.clone. The pending block of the original is encoded first.
+func (f *MemFile) clone() (*MemFile, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.data.flush(); err != nil {
+		return nil, err
+	}
+	return &MemFile{
+		Name:       f.Name,
+		data:       f.data.clone(),
+		modTime:    f.modTime,
+		accessTime: f.accessTime,
+		changeTime: f.changeTime,
+		owner:      f.owner,
+		group:      f.group,
+		position:   f.position,
+		closed:     f.closed,
+		mode:       f.mode,
+		refCount:   f.refCount,
+		ino:        f.ino,
+	}, nil
+}
+
+// release ends sharing the contents of the file with c, a clone that is no
+// longer used
+func (f *MemFile) release(c *MemFile) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.data.release(&c.data)
+}
+
+// Bytes returns a copy of the file contents, or nil if they cannot be
+// decrypted or decompressed; ReadAt reports why
+func (f *MemFile) Bytes() []byte {
+	data, err := f.contents()
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// contents returns a copy of the file contents, or the error decrypting or
+// decompressing them
+func (f *MemFile) contents() ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.data.bytes()
+}
+
+// Size returns the current length of the file contents
+func (f *MemFile) Size() int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.data.len()
+}
+
 // Close the memory file
 func (f *MemFile) Close() error {
 	f.mu.Lock()
@@ -106,11 +216,14 @@ func (f *MemFile) Stat() (os.FileInfo, error) {
 	defer f.mu.RUnlock()
 	return &MemFileInfo{
 		name:       f.Name,
-		size:       f.size,
+		size:       f.data.len(),
+		storedSize: f.data.storedLen(),
 		modTime:    f.modTime,
 		accessTime: f.accessTime,
 		changeTime: f.changeTime,
+		mode:       f.mode,
 		owner:      f.owner,
+		group:      f.group,
 	}, nil
 }
 
@@ -131,7 +244,7 @@ func (f *MemFile) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekCurrent:
 		abs = f.position + offset
 	case io.SeekEnd:
-		abs = int64(f.Data.Len()) + offset
+		abs = f.data.len() + offset
 	default:
 		return 0, errors.New("invalid whence")
 	}
@@ -151,6 +264,8 @@ type MemFileInfo struct {
 	changeTime time.Time
 	mode       os.FileMode
 	owner      string
+	group      string
+	storedSize int64
 }
 
 func (fi *MemFileInfo) Name() string          { return fi.name }
@@ -160,5 +275,10 @@ func (fi *MemFileInfo) ModTime() time.Time    { return fi.modTime }
 func (fi *MemFileInfo) AccessTime() time.Time { return fi.accessTime }
 func (fi *MemFileInfo) ChangeTime() time.Time { return fi.changeTime }
 func (fi *MemFileInfo) Owner() string         { return fi.owner }
-func (fi *MemFileInfo) IsDir() bool           { return false }
+func (fi *MemFileInfo) Group() string         { return fi.group }
+func (fi *MemFileInfo) IsDir() bool           { return fi.mode.IsDir() }
 func (fi *MemFileInfo) Sys() interface{}      { return nil }
+
+// StoredSize returns the number of bytes used to store the file contents,
+// which is less than Size for compressed files
+func (fi *MemFileInfo) StoredSize() int64 { return fi.storedSize }
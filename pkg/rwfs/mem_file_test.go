@@ -0,0 +1,82 @@
+package rwfs
+
+import (
+	"io"
+	"testing"
+)
+
+func TestMemFileRandomAccess(t *testing.T) {
+	for _, test := range testConfigs {
+		t.Run(test.name, func(t *testing.T) {
+			fs, err := NewLocalFileSystem(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fs.CreateFile("/a", "", ReadWrite); err != nil {
+				t.Fatal(err)
+			}
+			file := fs.RootDir.Entries["a"]
+			if _, err := file.WriteAt([]byte("hello"), 0); err != nil {
+				t.Fatal(err)
+			}
+
+			// Reads at or past the end return io.EOF, short reads return
+			// what is there along with io.EOF
+			buf := make([]byte, 4)
+			for _, off := range []int64{5, 100} {
+				if n, err := file.ReadAt(buf, off); n != 0 || err != io.EOF {
+					t.Errorf("ReadAt(%d) = %d, %v; want 0, io.EOF", off, n, err)
+				}
+			}
+			if n, err := file.ReadAt(buf, 3); n != 2 || err != io.EOF || string(buf[:n]) != "lo" {
+				t.Errorf("short ReadAt = %d, %q, %v; want 2, \"lo\", io.EOF", n, buf[:n], err)
+			}
+			if n, err := file.ReadAt(buf, 1); n != 4 || err != nil || string(buf) != "ello" {
+				t.Errorf("ReadAt = %d, %q, %v; want 4, \"ello\", nil", n, buf, err)
+			}
+
+			// Writing past the end fills the gap with zeros
+			if _, err := file.WriteAt([]byte("!"), 8); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(file.Bytes()); got != "hello\x00\x00\x00!" {
+				t.Errorf("after WriteAt past the end = %q", got)
+			}
+
+			// Append ignores the position
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := file.Append([]byte("?")); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(file.Bytes()); got != "hello\x00\x00\x00!?" {
+				t.Errorf("after Append = %q", got)
+			}
+
+			// Truncate shrinks and grows, and the space it grows into is zero
+			if err := file.Truncate(2); err != nil {
+				t.Fatal(err)
+			}
+			if err := file.Truncate(4); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(file.Bytes()); got != "he\x00\x00" {
+				t.Errorf("after Truncate = %q, want %q", got, "he\x00\x00")
+			}
+
+			if _, err := file.ReadAt(buf, -1); err == nil {
+				t.Error("ReadAt at a negative offset succeeded")
+			}
+			if _, err := file.WriteAt(buf, -1); err == nil {
+				t.Error("WriteAt at a negative offset succeeded")
+			}
+			if err := file.Truncate(-1); err == nil {
+				t.Error("Truncate to a negative size succeeded")
+			}
+			if file.Size() != 4 {
+				t.Errorf("Size = %d after rejected calls, want 4", file.Size())
+			}
+		})
+	}
+}
@@ -2,72 +2,252 @@ package rwfs
 
 import (
 	// "fmt"
-	"errors"
+	"context"
 	"os"
+	"path"
 	"time"
 )
 
 // MemFileSystem represents an in-memory file system
 type MemFileSystem struct {
 	mu      RWMutex
-	Files   map[string]*MemFile
 	RootDir *MemDirectory
 	CWD     *MemDirectory
 	Config  FileSystemConfig
 	Cache   *FileCache
+
+	nextIno  uint64
+	umask    os.FileMode
+	key      *masterKey
+	keyErr   error // reason key is nil
+	recorder func(journalRecord) error
+	closed   bool // set under the write lock once the LocalFileSystem is closed
 }
 
 // NewMemFileSystem creates a new in-memory file system
 func NewMemFileSystem(config FileSystemConfig) *MemFileSystem {
-	rootDir := NewMemDirectory("/", DirPermission{Read: true, Write: true, Execute: true})
+	fs := newMemFileSystem(config)
+	if config.Encryption {
+		fs.key, fs.keyErr = newMasterKey(config)
+	}
+	return fs
+}
+
+// newMemFileSystem creates a file system without a master key
+func newMemFileSystem(config FileSystemConfig) *MemFileSystem {
+	rootDir := NewMemDirectory("/", Exec&^defaultUmask)
 	cache := NewFileCache()
 	return &MemFileSystem{
-		Files:   make(map[string]*MemFile),
 		RootDir: rootDir,
 		CWD:     rootDir,
+		Config:  config,
 		Cache:   cache,
+		umask:   defaultUmask,
+		keyErr:  ErrMasterKeyRequired,
+	}
+}
+
+// newFile creates a file whose contents are stored with codec, or in plain
+// form if codec is nil
+func (fs *MemFileSystem) newFile(name, owner string, mode os.FileMode, codec *blockCodec) *MemFile {
+	file := NewMemFile(name, owner, mode)
+	file.data = newFileData(codec)
+	return file
+}
+
+// fileCodec returns the codec for the contents of a new file. Options given
+// to CreateFile take precedence over the configuration of the file system.
+func (fs *MemFileSystem) fileCodec(opts fileOptions) (*blockCodec, error) {
+	name, level := opts.codec, opts.level
+	if name == "" && fs.Config.Compression {
+		name, level = fs.Config.Codec, fs.Config.CompressLevel
+		if name == "" {
+			name = DefaultCodec
+		}
+	}
+	return fs.newBlockCodec(name, level)
+}
+
+// newBlockCodec returns a codec compressing with the named codec, or not at
+// all if name is empty, and encrypting under a fresh data key if the file
+// system is encrypted. It returns nil if contents are stored in plain form.
+func (fs *MemFileSystem) newBlockCodec(name string, level int) (*blockCodec, error) {
+	c := &blockCodec{level: compressLevel(level)}
+	if name != "" {
+		codec, err := LookupCodec(name)
+		if err != nil {
+			return nil, err
+		}
+		c.codec = codec
+	}
+	if fs.Config.Encryption {
+		if fs.key == nil {
+			return nil, fs.keyErr
+		}
+		var err error
+		if c.aead, c.wrapped, err = newDataKey(fs.key.key); err != nil {
+			return nil, err
+		}
+		c.seal = sealVersion
+	}
+	if c.codec == nil && c.aead == nil {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// record passes a successful mutation to the recorder installed by a
+// LocalFileSystem journal, if any
+func (fs *MemFileSystem) record(rec journalRecord) error {
+	if fs.recorder == nil {
+		return nil
 	}
+	return fs.recorder(rec)
 }
 
-// MaintainCache starts a goroutine to periodically clear expired cache entries
-func (fs *MemFileSystem) MaintainCache() {
+// mutable returns os.ErrClosed once the LocalFileSystem owning the tree was
+// closed, so that mutations fail instead of being lost; the caller must hold
+// the lock, at least for reading. Mutations check it before changing anything.
+func (fs *MemFileSystem) mutable() error {
+	if fs.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+// MaintainCache periodically flushes the cache until ctx is done. It blocks,
+// so it is usually run in its own goroutine.
+func (fs *MemFileSystem) MaintainCache(ctx context.Context) {
 	ticker := time.NewTicker(time.Minute * 5)
-	for range ticker.C {
-		fs.Cache.Flush()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fs.Cache.Flush()
+		}
 	}
 }
 
-// Open opens a file in the current directory
+// Open opens the file at the given path
 func (fs *MemFileSystem) Open(name string) (File, error) {
 	return fs.OpenFile(name)
 }
 
-// Create creates a new file in the current directory
-func (fs *MemFileSystem) Create(name, owner string, permissions FilePermission) (File, error) {
-	return fs.CreateFile(name, owner, permissions)
+// Create creates or truncates the file at the given path, like os.Create
+func (fs *MemFileSystem) Create(name string) (File, error) {
+	return fs.OpenFileFlags(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, ReadWrite)
 }
 
-// Remove removes a file in the current directory
+// Remove removes the file or directory at the given path
 func (fs *MemFileSystem) Remove(name string) error {
+	info, err := fs.Stat(name)
+	if err == nil && info.IsDir() {
+		return fs.RemoveDir(name)
+	}
 	return fs.RemoveFile(name)
 }
 
-// Stat returns file information in the current directory
-func (fs *MemFileSystem) Stat(name string) (os.FileInfo, error) {
+// Mkdir creates a new directory at the given path with the permission bits
+// perm less the umask
+func (fs *MemFileSystem) Mkdir(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.mkdir(name, perm)
+}
+
+// ReadDir returns the entries of the directory at the given path sorted by name
+func (fs *MemFileSystem) ReadDir(name string) ([]os.DirEntry, error) {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
 
-	file, exists := fs.CWD.Entries[name]
-	if !exists {
-		return nil, os.ErrNotExist
+	dir, err := fs.walkDir(name)
+	if err != nil {
+		return nil, err
+	}
+	// Check if the directory has read permissions
+	if !dir.allows(permRead) {
+		return nil, errReadDenied
 	}
+	return readDir(dir), nil
+}
 
-	// Check if the file has read permissions
-	if !file.permissions.Read {
-		return nil, errors.New("read permission denied")
+// Chmod changes the permission bits of the file or directory at the given
+// path to those of mode, including the setuid, setgid and sticky bits. The
+// umask does not apply.
+func (fs *MemFileSystem) Chmod(name string, mode os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.mutable(); err != nil {
+		return err
 	}
 
-	return file.Stat()
+	dir, file, err := fs.lookup(name)
+	if err != nil {
+		return err
+	}
+	mode &= modeMask
+	if dir != nil {
+		dir.setMode(mode)
+	} else {
+		file.setMode(mode)
+	}
+	return fs.record(journalRecord{Op: journalChmod, Path: fs.absPath(name), Mode: mode})
+}
+
+// Chown changes the owner of the file or directory at the given path
+func (fs *MemFileSystem) Chown(name, owner string) error {
+	return fs.chown(name, func(o, _ *string) { *o = owner })
+}
+
+// Chgrp changes the group of the file or directory at the given path
+func (fs *MemFileSystem) Chgrp(name, group string) error {
+	return fs.chown(name, func(_, g *string) { *g = group })
+}
+
+// chown calls set with the owner and group of the file or directory at the
+// given path and records the change
+func (fs *MemFileSystem) chown(name string, set func(owner, group *string)) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.mutable(); err != nil {
+		return err
+	}
+
+	dir, file, err := fs.lookup(name)
+	if err != nil {
+		return err
+	}
+	var owner, group string
+	if dir != nil {
+		owner, group = dir.setOwner(set)
+	} else {
+		owner, group = file.setOwner(set)
+	}
+	return fs.record(journalRecord{Op: journalChown, Path: fs.absPath(name), Owner: owner, Target: group})
+}
+
+// Stat returns information about the file or directory at the given path.
+// Like stat(2), it only needs search permission on the directories leading
+// to it, not read permission on the entry itself.
+func (fs *MemFileSystem) Stat(name string) (os.FileInfo, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	dir, file, err := fs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if dir != nil {
+		return dir.Stat()
+	}
+
+	// Report the name the file was looked up with
+	return fileInfo(path.Base(fs.absPath(name)), file), nil
 }
 
 // Link creates a hard link to an existing file
@@ -75,40 +255,46 @@ func (fs *MemFileSystem) Link(oldName, newName string) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
+	if err := fs.mutable(); err != nil {
+		return err
+	}
+
 	// Check if the old file exists
-	oldFile, exists := fs.CWD.Entries[oldName]
+	oldParent, oldBase, err := fs.walkParent(oldName)
+	if err != nil {
+		return err
+	}
+	oldFile, exists := oldParent.Entries[oldBase]
 	if !exists {
 		return os.ErrNotExist
 	}
 
 	// Check if the new file already exists
-	if _, exists := fs.CWD.Entries[newName]; exists {
+	newParent, newBase, err := fs.walkParent(newName)
+	if err != nil {
+		return err
+	}
+	if _, exists := newParent.Entries[newBase]; exists {
+		return os.ErrExist
+	}
+	if _, exists := newParent.Dirs[newBase]; exists {
 		return os.ErrExist
 	}
 
+	// Check if the new parent directory has write permissions
+	if !newParent.allows(permWrite) {
+		return errWriteDenied
+	}
+
 	// Increment reference count and create new link
 	oldFile.refCount++
-	fs.CWD.Entries[newName] = oldFile
-	fs.CWD.modTime = time.Now()
-	return nil
+	newParent.Entries[newBase] = oldFile
+	newParent.modTime = time.Now()
+	return fs.record(journalRecord{Op: journalLink, Path: fs.absPath(newName), Target: fs.absPath(oldName)})
 }
 
-// Unlink removes a hard link to a file
+// Unlink removes a hard link to a file. The contents stay reachable through
+// the remaining links until the last one is removed.
 func (fs *MemFileSystem) Unlink(name string) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	// Check if the file exists
-	file, exists := fs.CWD.Entries[name]
-	if !exists {
-		return os.ErrNotExist
-	}
-
-	// Decrement reference count and remove link
-	file.refCount--
-	if file.refCount == 0 {
-		delete(fs.CWD.Entries, name)
-	}
-	fs.CWD.modTime = time.Now()
-	return nil
+	return fs.RemoveFile(name)
 }
@@ -0,0 +1,92 @@
+package rwfs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// OpenFileFlags opens the file at the given path following the semantics of
+// os.OpenFile. The access mode (os.O_RDONLY, os.O_WRONLY or os.O_RDWR) is
+// enforced on the returned handle, and os.O_CREATE, os.O_EXCL, os.O_TRUNC and
+// os.O_APPEND behave as they do for the os package. perm is only used when the
+// file is created.
+func (fs *MemFileSystem) OpenFileFlags(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	handle, err := fs.openFile(name, flag, "", perm, fileOptions{})
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return handle, nil
+}
+
+// openFile opens or creates the file at the given path. A new file gets the
+// permission bits perm less the umask. The caller must hold the write lock.
+func (fs *MemFileSystem) openFile(name string, flag int, owner string, perm os.FileMode, opts fileOptions) (*FileHandle, error) {
+	parent, base, err := fs.walkParent(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := parent.Dirs[base]; exists {
+		return nil, errors.New("is a directory")
+	}
+
+	handle := newFileHandle(fs, nil, name, flag)
+	file, exists := parent.Entries[base]
+	if exists {
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return nil, os.ErrExist
+		}
+		// Check the file permissions against the requested access mode
+		if handle.canRead() && !file.allows(permRead) {
+			return nil, errReadDenied
+		}
+		if handle.canWrite() && !file.allows(permWrite) {
+			return nil, errWriteDenied
+		}
+		if flag&os.O_TRUNC != 0 && handle.canWrite() {
+			if err := fs.truncateFile(file, 0); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if flag&os.O_CREATE == 0 {
+			return nil, os.ErrNotExist
+		}
+		// A trailing slash asks for a directory, which open cannot create
+		if strings.HasSuffix(name, "/") {
+			return nil, errors.New("is a directory")
+		}
+		if err := fs.mutable(); err != nil {
+			return nil, err
+		}
+		// Check if the parent directory has write permissions
+		if !parent.allows(permWrite) {
+			return nil, errWriteDenied
+		}
+		codec, err := fs.fileCodec(opts)
+		if err != nil {
+			return nil, err
+		}
+		fs.nextIno++
+		file = fs.newFile(base, owner, fs.createMode(perm), codec)
+		file.ino = fs.nextIno
+		parent.Entries[base] = file
+		parent.modTime = time.Now()
+		abs := fs.absPath(name)
+		fs.Cache.Put(abs, file, true)
+		rec := journalRecord{Op: journalCreate, Path: abs, Ino: file.ino, Owner: owner, Mode: file.mode}
+		if codec != nil && codec.codec != nil {
+			rec.Target, rec.Offset = codec.codec.Name(), int64(codec.level)
+		}
+		if err := fs.record(rec); err != nil {
+			return nil, err
+		}
+	}
+
+	handle.file = file
+	return handle, nil
+}
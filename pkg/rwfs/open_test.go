@@ -0,0 +1,73 @@
+package rwfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestOpenFileFlags(t *testing.T) {
+	fs := NewMemFileSystem(FileSystemConfig{})
+	file := openHandle(t, fs, "/a.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL)
+	if _, err := file.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := fs.OpenFileFlags("/a.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) || !errors.Is(err, os.ErrExist) {
+		t.Errorf("O_EXCL on an existing file: error = %v, want *os.PathError wrapping os.ErrExist", err)
+	}
+
+	// Writes through an O_APPEND handle go to the end wherever it points
+	appender := openHandle(t, fs, "/a.txt", os.O_WRONLY|os.O_APPEND)
+	if _, err := appender.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appender.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(readFile(t, fs, "/a.txt")); got != "hello world" {
+		t.Errorf("after O_APPEND write = %q, want %q", got, "hello world")
+	}
+
+	reader := openHandle(t, fs, "/a.txt", os.O_RDONLY)
+	if _, err := reader.Write([]byte("x")); err == nil {
+		t.Error("Write on an O_RDONLY handle succeeded")
+	}
+	if _, err := reader.WriteAt([]byte("x"), 0); err == nil {
+		t.Error("WriteAt on an O_RDONLY handle succeeded")
+	}
+	if got := string(readFile(t, fs, "/a.txt")); got != "hello world" {
+		t.Errorf("contents changed through an O_RDONLY handle: %q", got)
+	}
+
+	openHandle(t, fs, "/a.txt", os.O_WRONLY|os.O_TRUNC)
+	if info, err := fs.Stat("/a.txt"); err != nil || info.Size() != 0 {
+		t.Errorf("after O_TRUNC: Stat = %v, %v; want size 0", info, err)
+	}
+}
+
+func TestOpenErrorsArePathErrors(t *testing.T) {
+	fs := NewMemFileSystem(FileSystemConfig{})
+	if _, err := fs.CreateFile("/a.txt", "", ReadWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		open func() (File, error)
+		want error
+	}{
+		{"CreateFile", func() (File, error) { return fs.CreateFile("/a.txt", "", ReadWrite) }, os.ErrExist},
+		{"OpenFile", func() (File, error) { return fs.OpenFile("/missing.txt") }, os.ErrNotExist},
+		{"OpenFileFlags", func() (File, error) { return fs.OpenFileFlags("/missing.txt", os.O_RDONLY, 0) }, os.ErrNotExist},
+	} {
+		_, err := test.open()
+		var pathErr *os.PathError
+		if !errors.As(err, &pathErr) || pathErr.Op != "open" || !errors.Is(err, test.want) {
+			t.Errorf("%s: error = %#v, want *os.PathError wrapping %v", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package rwfs
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+)
+
+// fullPath returns the absolute slash-separated path of the directory
+func (dir *MemDirectory) fullPath() string {
+	if dir.parent == nil {
+		return "/"
+	}
+	return path.Join(dir.parent.fullPath(), dir.Name)
+}
+
+// absPath returns the cleaned absolute form of name. Relative names are
+// interpreted against the current working directory.
+func (fs *MemFileSystem) absPath(name string) string {
+	if !path.IsAbs(name) {
+		name = path.Join(fs.CWD.fullPath(), name)
+	}
+	return path.Clean(name)
+}
+
+// walkDir resolves name to a directory, starting at the root directory for
+// absolute paths and at the current working directory otherwise. Every
+// directory traversed on the way must grant execute permission.
+func (fs *MemFileSystem) walkDir(name string) (*MemDirectory, error) {
+	dir := fs.RootDir
+	for _, elem := range strings.Split(fs.absPath(name), "/") {
+		if elem == "" {
+			continue
+		}
+		if !dir.allows(permExecute) {
+			return nil, errExecuteDenied
+		}
+		next, exists := dir.Dirs[elem]
+		if !exists {
+			if _, isFile := dir.Entries[elem]; isFile {
+				return nil, ErrNotDir
+			}
+			return nil, os.ErrNotExist
+		}
+		dir = next
+	}
+	return dir, nil
+}
+
+// walkParent resolves every element of name but the last one and returns the
+// containing directory together with the final element. The root directory
+// has no parent, so it cannot be resolved this way. A trailing slash says that
+// the final element is a directory, so it must not name a file.
+func (fs *MemFileSystem) walkParent(name string) (*MemDirectory, string, error) {
+	abs := fs.absPath(name)
+	if abs == "/" {
+		return nil, "", errors.New("invalid path: root directory")
+	}
+	dirName, base := path.Split(abs)
+	parent, err := fs.walkDir(dirName)
+	if err != nil {
+		return nil, "", err
+	}
+	if !parent.allows(permExecute) {
+		return nil, "", errExecuteDenied
+	}
+	if _, isFile := parent.Entries[base]; isFile && strings.HasSuffix(name, "/") {
+		return nil, "", ErrNotDir
+	}
+	return parent, base, nil
+}
+
+// lookup resolves name to either a directory or a file. Exactly one of the
+// returned pointers is non-nil when err is nil.
+func (fs *MemFileSystem) lookup(name string) (*MemDirectory, *MemFile, error) {
+	if fs.absPath(name) == "/" {
+		return fs.RootDir, nil, nil
+	}
+	parent, base, err := fs.walkParent(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dir, exists := parent.Dirs[base]; exists {
+		return dir, nil, nil
+	}
+	if file, exists := parent.Entries[base]; exists {
+		return nil, file, nil
+	}
+	return nil, nil, os.ErrNotExist
+}
+
+// PWD returns the absolute path of the current working directory
+func (fs *MemFileSystem) PWD() string {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.CWD.fullPath()
+}
@@ -0,0 +1,100 @@
+package rwfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+func TestPathResolution(t *testing.T) {
+	mem := newTestTree(t)
+	if err := mem.ChangeDir("/a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a/b/c.txt", "b/c.txt", "./b/../b/c.txt", "../a/b/c.txt", "//a///b/c.txt"} {
+		if got := string(readFile(t, mem, name)); got != "hello" {
+			t.Errorf("%s = %q, want %q", name, got, "hello")
+		}
+	}
+	if mem.PWD() != "/a" {
+		t.Errorf("PWD = %q, want /a", mem.PWD())
+	}
+	if _, err := mem.Stat("/top.txt/c.txt"); !errors.Is(err, ErrNotDir) {
+		t.Errorf("Stat through a file: error = %v, want ErrNotDir", err)
+	}
+	if _, err := mem.Stat("/a/missing/c.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat through a missing directory: error = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	mem := newTestTree(t)
+	for op, err := range map[string]error{
+		"open":   openErr(mem.OpenFile("/top.txt/")),
+		"flags":  openErr(mem.OpenFileFlags("/top.txt/", os.O_RDWR, 0)),
+		"stat":   statErr(mem.Stat("/a/b/c.txt/")),
+		"rename": mem.Rename("/top.txt/", "/moved.txt"),
+		"remove": mem.Remove("/top.txt/"),
+	} {
+		if !errors.Is(err, ErrNotDir) {
+			t.Errorf("%s with a trailing slash on a file: error = %v, want ErrNotDir", op, err)
+		}
+	}
+	if _, err := mem.OpenFileFlags("/new.txt/", os.O_RDWR|os.O_CREATE, 0644); err == nil {
+		t.Error("creating a file through a trailing slash succeeded")
+	}
+	if _, err := mem.Stat("/new.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat(/new.txt) error = %v, want os.ErrNotExist", err)
+	}
+
+	// Directories are still found with a trailing slash
+	if info, err := mem.Stat("/a/b/"); err != nil || !info.IsDir() {
+		t.Errorf("Stat(/a/b/) = %v, %v; want a directory", info, err)
+	}
+	if got := string(readFile(t, mem, "/top.txt")); got != "top" {
+		t.Errorf("top.txt = %q, want %q", got, "top")
+	}
+}
+
+func TestPermissionErrors(t *testing.T) {
+	mem := newTestTree(t)
+	if err := mem.Chmod("/top.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Chmod("/empty", 0500); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Chmod("/a", 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for op, err := range map[string]error{
+		"open unreadable file":      openErr(mem.OpenFileFlags("/top.txt", os.O_RDONLY, 0)),
+		"open unwritable file":      openErr(mem.OpenFileFlags("/top.txt", os.O_WRONLY, 0)),
+		"create in read-only dir":   openErr(mem.CreateFile("/empty/new.txt", "", ReadWrite)),
+		"mkdir in read-only dir":    mem.Mkdir("/empty/sub", 0755),
+		"search denied":             openErr(mem.Open("/a/b/c.txt")),
+		"stat below search denied":  statErr(mem.Stat("/a/b")),
+		"change into search denied": mem.ChangeDir("/a/b"),
+		"rename into search denied": mem.Rename("/empty", "/a/empty"),
+		"remove below search":       mem.Remove("/a/link.txt"),
+		"remove all below search":   mem.RemoveAll("/a"),
+	} {
+		if !errors.Is(err, fs.ErrPermission) || !errors.Is(err, ErrPermissionDenied) {
+			t.Errorf("%s: error = %v, want fs.ErrPermission", op, err)
+		}
+	}
+
+	if _, err := fs.ReadFile(NewIOFS(mem), "a/b/c.txt"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("IOFS ReadFile below search denied: error = %v, want fs.ErrPermission", err)
+	}
+}
+
+func openErr(_ File, err error) error {
+	return err
+}
+
+func statErr(_ os.FileInfo, err error) error {
+	return err
+}
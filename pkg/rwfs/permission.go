@@ -2,6 +2,7 @@ package rwfs
 
 import (
 	"os"
+	"time"
 )
 
 // Predefined file modes for convenience
@@ -12,14 +13,43 @@ const (
 	Exec      = os.FileMode(0777)
 )
 
-// FilePermission represents file permissions
+// Permissions
+//
+// Files and directories carry an os.FileMode with read, write and execute
+// bits for their owner, their group and everybody else, plus the setuid,
+// setgid and sticky bits. New entries get the requested mode with the bits of
+// the umask of the file system cleared, 022 unless changed with Umask.
+//
+// The file system does not know who is calling it, so it acts as the owner of
+// every entry: access checks use the owner bits of the mode. The group and
+// other bits are kept, reported by Stat and saved in snapshots for consumers
+// such as archive exporters.
+
+// modeMask holds the bits of an os.FileMode that are stored as permissions
+const modeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// defaultUmask is the umask of a new file system
+const defaultUmask = os.FileMode(022)
+
+// Owner permission bits checked on access
+const (
+	permRead    = os.FileMode(0400)
+	permWrite   = os.FileMode(0200)
+	permExecute = os.FileMode(0100)
+)
+
+// FilePermission represents file permissions.
+//
+// Deprecated: Use os.FileMode permission bits; see FilePermission.Mode.
 type FilePermission struct {
 	Read    bool
 	Write   bool
 	Execute bool
 }
 
-// DirPermission represents directory permissions
+// DirPermission represents directory permissions.
+//
+// Deprecated: Use os.FileMode permission bits; see DirPermission.Mode.
 type DirPermission struct {
 	Read    bool
 	Write   bool
@@ -27,45 +57,129 @@ type DirPermission struct {
 	List    bool
 }
 
-// SetFilePermissions sets permissions for a file
-func (f *MemFile) SetFilePermissions(permissions FilePermission) {
+// Mode returns the permission bits granting the permissions to the owner, the
+// group and others alike, before the umask is applied
+func (p FilePermission) Mode() os.FileMode {
+	var mode os.FileMode
+	if p.Read {
+		mode |= 0444
+	}
+	if p.Write {
+		mode |= 0222
+	}
+	if p.Execute {
+		mode |= 0111
+	}
+	return mode
+}
+
+// Mode returns the permission bits granting the permissions to the owner, the
+// group and others alike, before the umask is applied
+func (p DirPermission) Mode() os.FileMode {
+	return FilePermission{Read: p.Read || p.List, Write: p.Write, Execute: p.Execute}.Mode()
+}
+
+// ownerPermission returns the owner bits of mode as a FilePermission
+func ownerPermission(mode os.FileMode) FilePermission {
+	return FilePermission{
+		Read:    mode&permRead != 0,
+		Write:   mode&permWrite != 0,
+		Execute: mode&permExecute != 0,
+	}
+}
+
+// legacyMode returns the mode of an entry saved with boolean permissions only,
+// given the Mode of those permissions
+func legacyMode(perm os.FileMode) os.FileMode {
+	return perm &^ defaultUmask
+}
+
+// Umask sets the umask applied to the mode of files and directories created
+// from now on and returns the previous one
+func (fs *MemFileSystem) Umask(mask os.FileMode) os.FileMode {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	old := fs.umask
+	fs.umask = mask & os.ModePerm
+	return old
+}
+
+// createMode returns the mode of a new entry requested with perm; the caller
+// must hold the lock
+func (fs *MemFileSystem) createMode(perm os.FileMode) os.FileMode {
+	return perm & modeMask &^ fs.umask
+}
+
+// allows reports whether the owner bits of the file mode grant perm
+func (f *MemFile) allows(perm os.FileMode) bool {
+	return f.mode&perm == perm
+}
+
+// allows reports whether the owner bits of the directory mode grant perm
+func (d *MemDirectory) allows(perm os.FileMode) bool {
+	return d.mode&perm == perm
+}
+
+// setMode changes the permission bits of a file
+func (f *MemFile) setMode(mode os.FileMode) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	f.permissions = permissions
+	f.mode = mode & modeMask
+	f.changeTime = time.Now()
 }
 
-// SetDirPermissions sets permissions for a directory
-func (d *MemDirectory) SetDirPermissions(permissions DirPermission) {
+// setMode changes the permission bits of a directory
+func (d *MemDirectory) setMode(mode os.FileMode) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.mode = mode & modeMask
+}
+
+// setOwner calls set with the owner and group of a file and returns them
+// after the change
+func (f *MemFile) setOwner(set func(owner, group *string)) (string, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	set(&f.owner, &f.group)
+	f.changeTime = time.Now()
+	return f.owner, f.group
+}
+
+// setOwner calls set with the owner and group of a directory and returns them
+// after the change
+func (d *MemDirectory) setOwner(set func(owner, group *string)) (string, string) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.permissions = permissions
+	set(&d.owner, &d.group)
+	return d.owner, d.group
+}
+
+// SetFilePermissions sets permissions for a file.
+//
+// Deprecated: Use MemFileSystem.Chmod.
+func (f *MemFile) SetFilePermissions(permissions FilePermission) {
+	f.setMode(permissions.Mode())
+}
+
+// SetDirPermissions sets permissions for a directory.
+//
+// Deprecated: Use MemFileSystem.Chmod.
+func (d *MemDirectory) SetDirPermissions(permissions DirPermission) {
+	d.setMode(permissions.Mode())
 }
+
+// CheckFilePermission reports whether the owner bits of the file mode grant
+// the owner bits of permission
 func (f *MemFile) CheckFilePermission(permission os.FileMode) bool {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
-	if permission&os.FileMode(0400) != 0 && !f.permissions.Read {
-		return false
-	}
-	if permission&os.FileMode(0200) != 0 && !f.permissions.Write {
-		return false
-	}
-	if permission&os.FileMode(0100) != 0 && !f.permissions.Execute {
-		return false
-	}
-	return true
+	return f.allows(permission & 0700)
 }
 
+// CheckDirPermission reports whether the owner bits of the directory mode
+// grant the owner bits of permission
 func (d *MemDirectory) CheckDirPermission(permission os.FileMode) bool {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
-	if permission&os.FileMode(0400) != 0 && !d.permissions.Read {
-		return false
-	}
-	if permission&os.FileMode(0200) != 0 && !d.permissions.Write {
-		return false
-	}
-	if permission&os.FileMode(0100) != 0 && !d.permissions.Execute {
-		return false
-	}
-	return true
+	return d.allows(permission & 0700)
 }
@@ -0,0 +1,113 @@
+package rwfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkMode fails the test unless Stat reports exactly mode for name
+func checkMode(t *testing.T, fs FileSystem, name string, mode os.FileMode) {
+	t.Helper()
+	info, err := fs.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != mode {
+		t.Errorf("%s: mode = %v, want %v", name, info.Mode(), mode)
+	}
+}
+
+func TestUmask(t *testing.T) {
+	fs := NewMemFileSystem(FileSystemConfig{})
+	if _, err := fs.CreateFile("/a.txt", "", ReadWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/a", Exec); err != nil {
+		t.Fatal(err)
+	}
+	checkMode(t, fs, "/a.txt", 0644)
+	checkMode(t, fs, "/a", os.ModeDir|0755)
+
+	if old := fs.Umask(027); old != defaultUmask {
+		t.Errorf("Umask returned %v, want %v", old, defaultUmask)
+	}
+	if _, err := fs.CreateFile("/b.txt", "", ReadWrite); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Create("/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/b", Exec|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+	checkMode(t, fs, "/b.txt", 0640)
+	checkMode(t, fs, "/c.txt", 0640)
+	checkMode(t, fs, "/b", os.ModeDir|os.ModeSetgid|0750)
+
+	// Entries created before the change keep their mode
+	checkMode(t, fs, "/a.txt", 0644)
+}
+
+func TestStatModeBits(t *testing.T) {
+	fs := NewMemFileSystem(FileSystemConfig{})
+	if _, err := fs.CreateFile("/a.txt", "", ReadWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/a", Exec); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chmod ignores the umask and keeps the special bits, but drops any
+	// other bit of the mode
+	if err := fs.Chmod("/a.txt", os.ModeSetuid|os.ModeNamedPipe|0754); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chmod("/a", os.ModeSticky|0777); err != nil {
+		t.Fatal(err)
+	}
+	checkMode(t, fs, "/a.txt", os.ModeSetuid|0754)
+	checkMode(t, fs, "/a", os.ModeDir|os.ModeSticky|0777)
+}
+
+func TestChgrpPersists(t *testing.T) {
+	config := FileSystemConfig{Filepath: filepath.Join(t.TempDir(), "data.rwfs")}
+	fs, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.CreateFile("/a.txt", "alice", ReadWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/a", Exec); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a.txt", "/a"} {
+		if err := fs.Chgrp(name, "staff"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fs := range []*LocalFileSystem{fs, reopened} {
+		for _, name := range []string{"/a.txt", "/a"} {
+			info, err := fs.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if group := info.(*MemFileInfo).Group(); group != "staff" {
+				t.Errorf("%s: group = %q, want %q", name, group, "staff")
+			}
+		}
+		info, _ := fs.Stat("/a.txt")
+		if owner := info.(*MemFileInfo).Owner(); owner != "alice" {
+			t.Errorf("Chgrp changed the owner to %q", owner)
+		}
+	}
+}
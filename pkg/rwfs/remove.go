@@ -0,0 +1,170 @@
+package rwfs
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// MkdirAll creates the directory at the given path along with any missing
+// parents, like os.MkdirAll. It does nothing if the directory already exists,
+// and creates nothing if any of the directories cannot be created.
+func (fs *MemFileSystem) MkdirAll(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.mutable(); err != nil {
+		return err
+	}
+
+	abs := fs.absPath(name)
+	mode := fs.createMode(perm)
+
+	// Resolve the existing part of the path and check every permission
+	// before creating anything, so that a failure leaves no directories
+	// behind that the journal does not know about
+	dir := fs.RootDir
+	var missing []string
+	elems := strings.Split(abs, "/")
+	for i, elem := range elems {
+		if elem == "" {
+			continue
+		}
+		if !dir.allows(permExecute) {
+			return errExecuteDenied
+		}
+		if _, isFile := dir.Entries[elem]; isFile {
+			return ErrNotDir
+		}
+		next, exists := dir.Dirs[elem]
+		if !exists {
+			missing = elems[i:]
+			break
+		}
+		dir = next
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	// Check if the parent directory has write permissions
+	if !dir.allows(permWrite) {
+		return errWriteDenied
+	}
+	// Each new directory but the last one gets another one created in it
+	if len(missing) > 1 && mode&permExecute == 0 {
+		return errExecuteDenied
+	}
+	if len(missing) > 1 && mode&permWrite == 0 {
+		return errWriteDenied
+	}
+
+	for _, elem := range missing {
+		next := NewMemDirectory(elem, mode)
+		next.parent = dir
+		dir.Dirs[elem] = next
+		dir.modTime = time.Now()
+		dir = next
+	}
+	return fs.record(journalRecord{Op: journalMkdir, Path: abs, Mode: mode})
+}
+
+// RemoveAll removes the file or directory at the given path together with
+// everything it contains, like os.RemoveAll. It returns nil if the path does
+// not exist. Every directory in the tree must grant write permission, and
+// nothing is removed unless all of them do.
+func (fs *MemFileSystem) RemoveAll(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.mutable(); err != nil {
+		return err
+	}
+
+	parent, base, err := fs.walkParent(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Check if the parent directory has write permissions
+	if !parent.allows(permWrite) {
+		return errWriteDenied
+	}
+
+	abs := fs.absPath(name)
+	if _, exists := parent.Entries[base]; exists {
+		fs.removeEntry(parent, base, abs)
+		parent.modTime = time.Now()
+		return fs.record(journalRecord{Op: journalRemove, Path: abs})
+	}
+	dir, exists := parent.Dirs[base]
+	if !exists {
+		return nil
+	}
+	if fs.containsCWD(dir) {
+		return errors.New("cannot remove directory: current working directory")
+	}
+	if err := checkRemovable(dir); err != nil {
+		return err
+	}
+	fs.removeTree(dir, abs)
+	delete(parent.Dirs, base)
+	dir.parent = nil
+	parent.modTime = time.Now()
+	return fs.record(journalRecord{Op: journalRemove, Path: abs})
+}
+
+// checkRemovable verifies that every directory in the tree grants the
+// permissions needed to remove its entries
+func checkRemovable(dir *MemDirectory) error {
+	if len(dir.Entries) == 0 && len(dir.Dirs) == 0 {
+		return nil
+	}
+	if !dir.allows(permWrite | permExecute) {
+		return errWriteDenied
+	}
+	for _, sub := range dir.Dirs {
+		if err := checkRemovable(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeTree removes every entry below dir, whose absolute path is dirPath
+func (fs *MemFileSystem) removeTree(dir *MemDirectory, dirPath string) {
+	for base := range dir.Entries {
+		fs.removeEntry(dir, base, path.Join(dirPath, base))
+	}
+	for base, sub := range dir.Dirs {
+		fs.removeTree(sub, path.Join(dirPath, base))
+		delete(dir.Dirs, base)
+		sub.parent = nil
+	}
+}
+
+// removeEntry unlinks the file entry base from dir, releasing one hard link
+// reference and its cache entry; the caller must hold the write lock
+func (fs *MemFileSystem) removeEntry(dir *MemDirectory, base, abs string) {
+	file := dir.Entries[base]
+	delete(dir.Entries, base)
+	file.mu.Lock()
+	file.refCount--
+	file.changeTime = time.Now()
+	file.mu.Unlock()
+	fs.Cache.Remove(abs)
+}
+
+// containsCWD reports whether the current working directory is dir or one of
+// its descendants
+func (fs *MemFileSystem) containsCWD(dir *MemDirectory) bool {
+	for cwd := fs.CWD; cwd != nil; cwd = cwd.parent {
+		if cwd == dir {
+			return true
+		}
+	}
+	return false
+}
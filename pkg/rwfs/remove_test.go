@@ -0,0 +1,93 @@
+package rwfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+func TestMkdirAll(t *testing.T) {
+	mem := newTestTree(t)
+	if err := mem.MkdirAll("/a/b/x/y/z", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := mem.Stat("/a/b/x/y/z"); err != nil || !info.IsDir() {
+		t.Errorf("Stat of the new directory: %v, %v", info, err)
+	}
+	if err := mem.MkdirAll("/a/b/x", 0755); err != nil {
+		t.Errorf("MkdirAll of an existing directory: %v", err)
+	}
+	if err := mem.MkdirAll("/top.txt/x", 0755); !errors.Is(err, ErrNotDir) {
+		t.Errorf("MkdirAll through a file: error = %v, want ErrNotDir", err)
+	}
+
+	if err := mem.Chmod("/empty", 0500); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Chmod("/a/b/x", 0600); err != nil {
+		t.Fatal(err)
+	}
+	for op, err := range map[string]error{
+		"in read-only dir":         mem.MkdirAll("/empty/x/y", 0755),
+		"below search denied":      mem.MkdirAll("/a/b/x/y/w", 0755),
+		"unwritable intermediates": mem.MkdirAll("/a/new/x", 0555),
+	} {
+		if !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%s: error = %v, want fs.ErrPermission", op, err)
+		}
+	}
+	for _, name := range []string{"/empty/x", "/a/new"} {
+		if _, err := mem.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("failed MkdirAll left %s behind: Stat error = %v", name, err)
+		}
+	}
+	// A single read-only directory can still be created
+	if err := mem.MkdirAll("/a/new", 0555); err != nil {
+		t.Errorf("MkdirAll of one read-only directory: %v", err)
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	mem := newTestTree(t)
+	if err := mem.RemoveAll("/missing/x"); err != nil {
+		t.Errorf("RemoveAll of a missing path: %v", err)
+	}
+	if err := mem.RemoveAll("/top.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, mem, "/a/link.txt"); string(got) != "top" {
+		t.Errorf("link.txt = %q after removing the other link, want %q", got, "top")
+	}
+
+	// A directory without write permission deep in the tree keeps the whole
+	// tree from being removed
+	if err := mem.Chmod("/a/b", 0500); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.RemoveAll("/a"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("RemoveAll with a read-only subdirectory: error = %v, want fs.ErrPermission", err)
+	}
+	for _, name := range []string{"/a/link.txt", "/a/b/c.txt"} {
+		if _, err := mem.Stat(name); err != nil {
+			t.Errorf("failed RemoveAll removed %s: %v", name, err)
+		}
+	}
+
+	// Empty directories need no permissions to be removed
+	if err := mem.Chmod("/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Chmod("/empty", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Rename("/empty", "/a/empty"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.RemoveAll("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("/a"); !os.IsNotExist(err) {
+		t.Errorf("Stat after RemoveAll: error = %v, want not exist", err)
+	}
+}
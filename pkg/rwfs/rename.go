@@ -0,0 +1,107 @@
+package rwfs
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// Rename moves the file or directory at oldName to newName, possibly into
+// another directory. Like os.Rename, an existing file or empty directory at
+// newName is replaced. The move is atomic with respect to other operations
+// on the file system.
+func (fs *MemFileSystem) Rename(oldName, newName string) error {
+	return fs.rename(oldName, newName, true)
+}
+
+// RenameNoReplace moves the file or directory at oldName to newName, failing
+// with os.ErrExist if newName already exists.
+func (fs *MemFileSystem) RenameNoReplace(oldName, newName string) error {
+	return fs.rename(oldName, newName, false)
+}
+
+func (fs *MemFileSystem) rename(oldName, newName string, replace bool) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.mutable(); err != nil {
+		return err
+	}
+
+	oldParent, oldBase, err := fs.walkParent(oldName)
+	if err != nil {
+		return err
+	}
+	newParent, newBase, err := fs.walkParent(newName)
+	if err != nil {
+		return err
+	}
+	// Check if both parent directories have write permissions
+	if !oldParent.allows(permWrite) || !newParent.allows(permWrite) {
+		return errWriteDenied
+	}
+
+	oldPath, newPath := fs.absPath(oldName), fs.absPath(newName)
+	dir, isDir := oldParent.Dirs[oldBase]
+	file, isFile := oldParent.Entries[oldBase]
+	if !isDir && !isFile {
+		return os.ErrNotExist
+	}
+	if oldPath == newPath {
+		return nil
+	}
+
+	if isDir {
+		// Refuse to move a directory inside itself
+		for d := newParent; d != nil; d = d.parent {
+			if d == dir {
+				return errors.New("cannot move a directory inside itself")
+			}
+		}
+		if _, exists := newParent.Entries[newBase]; exists {
+			return ErrNotDir
+		}
+		if target, exists := newParent.Dirs[newBase]; exists {
+			if !replace {
+				return os.ErrExist
+			}
+			if len(target.Entries) > 0 || len(target.Dirs) > 0 {
+				return ErrDirNotEmpty
+			}
+			if fs.containsCWD(target) {
+				return errors.New("cannot replace directory: current working directory")
+			}
+			target.parent = nil
+		}
+		delete(oldParent.Dirs, oldBase)
+		dir.Name = newBase
+		dir.parent = newParent
+		newParent.Dirs[newBase] = dir
+	} else {
+		if _, exists := newParent.Dirs[newBase]; exists {
+			return errors.New("is a directory")
+		}
+		if target, exists := newParent.Entries[newBase]; exists {
+			if !replace {
+				return os.ErrExist
+			}
+			// Both names are hard links to the same file, nothing to do
+			if target == file {
+				return nil
+			}
+			fs.removeEntry(newParent, newBase, newPath)
+		}
+		delete(oldParent.Entries, oldBase)
+		file.mu.Lock()
+		file.Name = newBase
+		file.changeTime = time.Now()
+		file.mu.Unlock()
+		newParent.Entries[newBase] = file
+	}
+	fs.Cache.Rename(oldPath, newPath)
+
+	now := time.Now()
+	oldParent.modTime = now
+	newParent.modTime = now
+	return fs.record(journalRecord{Op: journalRename, Path: oldPath, Target: newPath})
+}
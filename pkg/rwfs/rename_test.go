@@ -0,0 +1,83 @@
+package rwfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRenameFile(t *testing.T) {
+	mem := newTestTree(t)
+	if err := mem.Rename("/a/b/c.txt", "/empty/moved.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("/a/b/c.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat of the old name: error = %v, want not exist", err)
+	}
+	if got := readFile(t, mem, "/empty/moved.txt"); string(got) != "hello" {
+		t.Errorf("moved.txt = %q, want %q", got, "hello")
+	}
+
+	// An existing file is replaced, but not by RenameNoReplace
+	if err := mem.RenameNoReplace("/top.txt", "/empty/moved.txt"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("RenameNoReplace onto a file: error = %v, want os.ErrExist", err)
+	}
+	if err := mem.Rename("/top.txt", "/empty/moved.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, mem, "/empty/moved.txt"); string(got) != "top" {
+		t.Errorf("moved.txt = %q after replacing it, want %q", got, "top")
+	}
+
+	// Renaming a hard link onto another link of the same file keeps both
+	if err := mem.Rename("/a/link.txt", "/empty/moved.txt"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a/link.txt", "/empty/moved.txt"} {
+		if got := readFile(t, mem, name); string(got) != "top" {
+			t.Errorf("%s = %q, want %q", name, got, "top")
+		}
+	}
+
+	if err := mem.Rename("/missing.txt", "/x.txt"); !os.IsNotExist(err) {
+		t.Errorf("Rename of a missing file: error = %v, want not exist", err)
+	}
+	if err := mem.Rename("/a/link.txt", "/a/b"); err == nil {
+		t.Error("Rename of a file onto a directory succeeded")
+	}
+}
+
+func TestRenameDir(t *testing.T) {
+	mem := newTestTree(t)
+	for _, test := range []struct {
+		name     string
+		rename   func(oldName, newName string) error
+		from, to string
+		want     error
+	}{
+		{"onto a file", mem.Rename, "/empty", "/top.txt", ErrNotDir},
+		{"onto a non-empty directory", mem.Rename, "/empty", "/a", ErrDirNotEmpty},
+		{"without replacing", mem.RenameNoReplace, "/a/b", "/empty", os.ErrExist},
+	} {
+		if err := test.rename(test.from, test.to); !errors.Is(err, test.want) {
+			t.Errorf("%s: error = %v, want %v", test.name, err, test.want)
+		}
+	}
+	if err := mem.Rename("/a", "/a/b/inner"); err == nil {
+		t.Error("moving a directory inside itself succeeded")
+	}
+
+	// An empty directory is replaced, and the contents move along
+	if err := mem.Rename("/a/b", "/empty"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, mem, "/empty/c.txt"); string(got) != "hello" {
+		t.Errorf("empty/c.txt = %q, want %q", got, "hello")
+	}
+	if _, err := mem.Stat("/a/b"); !os.IsNotExist(err) {
+		t.Errorf("Stat of the old name: error = %v, want not exist", err)
+	}
+	if err := mem.CreateDir("/empty/sub"); err != nil {
+		t.Errorf("CreateDir in the moved directory: %v", err)
+	}
+}
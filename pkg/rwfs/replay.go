@@ -0,0 +1,184 @@
+package rwfs
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// replayer applies journal records to the directory tree of a file system
+type replayer struct {
+	fs     *MemFileSystem
+	inodes map[uint64]*MemFile
+}
+
+// newReplayer prepares replaying journal records on the current tree of fs;
+// the caller must hold the write lock while records are applied
+func newReplayer(fs *MemFileSystem) *replayer {
+	r := &replayer{fs: fs, inodes: make(map[uint64]*MemFile)}
+	forEachFile(fs.RootDir, func(file *MemFile) {
+		r.inodes[file.ino] = file
+	})
+	return r
+}
+
+// apply replays a single record. Permissions are not checked again, since the
+// operation already passed the checks when it was recorded, and records whose
+// target no longer exists are skipped.
+func (r *replayer) apply(rec journalRecord) {
+	fs := r.fs
+	now := time.Now()
+	switch rec.Op {
+	case journalCreate:
+		parent, base := fs.findParent(rec.Path)
+		if parent == nil {
+			return
+		}
+		if _, exists := parent.Entries[base]; exists {
+			fs.removeEntry(parent, base, rec.Path)
+		}
+		codec, err := fs.newBlockCodec(rec.Target, int(rec.Offset))
+		if err != nil {
+			// Fall back to uncompressed contents if the codec is no longer
+			// registered
+			codec, _ = fs.newBlockCodec("", 0)
+		}
+		file := fs.newFile(base, rec.Owner, rec.Mode, codec)
+		file.ino = rec.Ino
+		parent.Entries[base] = file
+		parent.modTime = now
+		r.inodes[rec.Ino] = file
+		if rec.Ino > fs.nextIno {
+			fs.nextIno = rec.Ino
+		}
+	case journalWrite:
+		if file, exists := r.inodes[rec.Ino]; exists {
+			file.WriteAt(rec.Data, rec.Offset)
+		}
+	case journalTruncate:
+		if file, exists := r.inodes[rec.Ino]; exists {
+			file.Truncate(rec.Offset)
+		}
+	case journalRemove:
+		parent, base := fs.findParent(rec.Path)
+		if parent == nil {
+			return
+		}
+		if _, exists := parent.Entries[base]; exists {
+			fs.removeEntry(parent, base, rec.Path)
+		} else if dir, exists := parent.Dirs[base]; exists {
+			fs.removeTree(dir, rec.Path)
+			delete(parent.Dirs, base)
+			dir.parent = nil
+		}
+		parent.modTime = now
+	case journalMkdir:
+		dir := fs.RootDir
+		for _, elem := range strings.Split(rec.Path, "/") {
+			if elem == "" {
+				continue
+			}
+			next, exists := dir.Dirs[elem]
+			if !exists {
+				next = NewMemDirectory(elem, rec.Mode)
+				next.parent = dir
+				dir.Dirs[elem] = next
+				dir.modTime = now
+			}
+			dir = next
+		}
+	case journalChmod:
+		dir, file := fs.find(rec.Path)
+		switch {
+		case dir != nil:
+			dir.setMode(rec.Mode)
+		case file != nil:
+			file.setMode(rec.Mode)
+		}
+	case journalChown:
+		set := func(owner, group *string) { *owner, *group = rec.Owner, rec.Target }
+		dir, file := fs.find(rec.Path)
+		switch {
+		case dir != nil:
+			dir.setOwner(set)
+		case file != nil:
+			file.setOwner(set)
+		}
+	case journalLink:
+		oldParent, oldBase := fs.findParent(rec.Target)
+		newParent, newBase := fs.findParent(rec.Path)
+		if oldParent == nil || newParent == nil || oldParent.Entries[oldBase] == nil {
+			return
+		}
+		file := oldParent.Entries[oldBase]
+		file.refCount++
+		newParent.Entries[newBase] = file
+		newParent.modTime = now
+	case journalRename:
+		r.rename(rec.Path, rec.Target)
+	}
+}
+
+// rename moves the entry at oldPath to newPath, replacing whatever is there
+func (r *replayer) rename(oldPath, newPath string) {
+	fs := r.fs
+	oldParent, oldBase := fs.findParent(oldPath)
+	newParent, newBase := fs.findParent(newPath)
+	if oldParent == nil || newParent == nil {
+		return
+	}
+	if dir, exists := oldParent.Dirs[oldBase]; exists {
+		if target, exists := newParent.Dirs[newBase]; exists {
+			target.parent = nil
+		}
+		delete(oldParent.Dirs, oldBase)
+		dir.Name = newBase
+		dir.parent = newParent
+		newParent.Dirs[newBase] = dir
+	} else if file, exists := oldParent.Entries[oldBase]; exists {
+		if target, exists := newParent.Entries[newBase]; exists && target != file {
+			fs.removeEntry(newParent, newBase, newPath)
+		}
+		delete(oldParent.Entries, oldBase)
+		file.Name = newBase
+		newParent.Entries[newBase] = file
+	} else {
+		return
+	}
+	fs.Cache.Rename(oldPath, newPath)
+	now := time.Now()
+	oldParent.modTime = now
+	newParent.modTime = now
+}
+
+// find resolves the absolute path name to a directory or a file without
+// checking permissions, returning nil for both if it does not exist
+func (fs *MemFileSystem) find(name string) (*MemDirectory, *MemFile) {
+	if name == "/" {
+		return fs.RootDir, nil
+	}
+	parent, base := fs.findParent(name)
+	if parent == nil {
+		return nil, nil
+	}
+	if dir, exists := parent.Dirs[base]; exists {
+		return dir, nil
+	}
+	return nil, parent.Entries[base]
+}
+
+// findParent resolves the directory containing the absolute path name without
+// checking permissions, returning nil if it does not exist
+func (fs *MemFileSystem) findParent(name string) (*MemDirectory, string) {
+	dirName, base := path.Split(name)
+	dir := fs.RootDir
+	for _, elem := range strings.Split(dirName, "/") {
+		if elem == "" {
+			continue
+		}
+		if dir = dir.Dirs[elem]; dir == nil {
+			return nil, ""
+		}
+	}
+	return dir, base
+}
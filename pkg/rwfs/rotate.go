@@ -0,0 +1,167 @@
+package rwfs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+)
+
+// KeyID returns the ID of the master key, which every encrypted snapshot
+// records. Loading a snapshot encrypted with another key fails with a
+// KeyMismatchError naming the ID of the key it expects. KeyID is empty if no
+// key is configured.
+func (fs *LocalFileSystem) KeyID() string {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if fs.MemFileSystem.key == nil {
+		return ""
+	}
+	return fs.MemFileSystem.key.id()
+}
+
+// RotateKey moves the file system to a master key derived from the
+// passphrase newKey with a fresh salt; oldKey must be the current passphrase.
+// Only the data keys of the files and the journal key are encrypted again, so
+// the cost does not depend on the size of the file contents. With a Filepath
+// configured, a snapshot under the new key is written before RotateKey
+// returns. Backup generations keep the key they were written with.
+//
+// Readers are never blocked while the key is rotated, and writes to open
+// files go on. Creating and removing files waits for the moment the new key
+// is swapped in.
+func (fs *LocalFileSystem) RotateKey(oldKey, newKey string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	current := fs.MemFileSystem.key
+	if !fs.encryption || current == nil {
+		return errors.New("encryption is not enabled")
+	}
+	if fs.rawKey != nil {
+		return errors.New("file system uses a raw key: use RotateRawKey")
+	}
+	old := &masterKey{key: deriveKey(oldKey)}
+	if current.salt != nil {
+		old = passphraseKey(oldKey, current.salt, current.iterations)
+	}
+	if !hmac.Equal(old.key, current.key) {
+		return ErrWrongKey
+	}
+
+	config := fs.Config
+	config.EncryptionKey = newKey
+	next, err := newMasterKey(config)
+	if err != nil {
+		return err
+	}
+	err = fs.rotate(next)
+	if fs.MemFileSystem.key == next {
+		fs.useKey(newKey, nil)
+	}
+	return err
+}
+
+// RotateRawKey is RotateKey for file systems configured with
+// FileSystemConfig.EncryptionRawKey
+func (fs *LocalFileSystem) RotateRawKey(oldKey, newKey []byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	current := fs.MemFileSystem.key
+	if !fs.encryption || current == nil {
+		return errors.New("encryption is not enabled")
+	}
+	if fs.rawKey == nil {
+		return errors.New("file system uses a passphrase: use RotateKey")
+	}
+	if !hmac.Equal(oldKey, current.key) {
+		return ErrWrongKey
+	}
+	next, err := rawMasterKey(newKey)
+	if err != nil {
+		return err
+	}
+	err = fs.rotate(next)
+	if fs.MemFileSystem.key == next {
+		fs.useKey("", bytes.Clone(newKey))
+	}
+	return err
+}
+
+// rotate makes next the master key and writes a new snapshot; the caller must
+// hold the lock. The journal is encrypted with its own key, which is stored in
+// the snapshot, so it stays valid across the switch. If the snapshot cannot
+// be written, the previous key is restored, unless the snapshot under next
+// already replaced the old one and only a later step failed.
+func (fs *LocalFileSystem) rotate(next *masterKey) error {
+	previous := fs.MemFileSystem.key
+	if err := fs.MemFileSystem.rewrapKeys(next); err != nil {
+		return err
+	}
+	if fs.snapshotPath == "" {
+		return nil
+	}
+	if renamed, err := fs.save(); err != nil {
+		if !renamed {
+			// Keep the keys in line with the snapshot on disk
+			fs.MemFileSystem.rewrapKeys(previous)
+		}
+		return err
+	}
+	return nil
+}
+
+// useKey records the passphrase or raw key the master key was rotated to,
+// replacing the old one in the configuration as well
+func (fs *LocalFileSystem) useKey(passphrase string, raw []byte) {
+	fs.encryptionKey, fs.rawKey = passphrase, raw
+	fs.MemFileSystem.mu.Lock()
+	defer fs.MemFileSystem.mu.Unlock()
+	fs.Config.EncryptionKey, fs.Config.EncryptionRawKey = passphrase, raw
+}
+
+// rewrapKeys wraps the data keys of all files with next and makes it the
+// master key. The keys are wrapped under the read lock, so the write lock is
+// only held to swap them in.
+func (fs *MemFileSystem) rewrapKeys(next *masterKey) error {
+	fs.mu.RLock()
+	current := fs.key
+	wrapped, err := fs.rewrapFiles(current, next, make(map[*blockCodec][]byte))
+	fs.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	// Wrap the keys of files created in the meantime as well
+	if _, err := fs.rewrapFiles(current, next, wrapped); err != nil {
+		return err
+	}
+	for codec, key := range wrapped {
+		codec.wrapped = key
+	}
+	fs.key = next
+	return nil
+}
+
+// rewrapFiles adds the data keys of all files that are not in done yet to
+// done, unwrapped with current and wrapped again with next
+func (fs *MemFileSystem) rewrapFiles(current, next *masterKey, done map[*blockCodec][]byte) (map[*blockCodec][]byte, error) {
+	var err error
+	forEachFile(fs.RootDir, func(file *MemFile) {
+		codec := file.data.codec
+		if err != nil || codec == nil || codec.wrapped == nil {
+			return
+		}
+		if _, exists := done[codec]; exists {
+			return
+		}
+		var dataKey []byte
+		if dataKey, err = unwrapDataKey(codec.wrapped, current.key); err == nil {
+			done[codec], err = sealData(dataKey, next.key)
+		}
+	})
+	return done, err
+}
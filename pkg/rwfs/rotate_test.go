@@ -0,0 +1,134 @@
+package rwfs
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotateKey(t *testing.T) {
+	config := FileSystemConfig{
+		Filepath:      filepath.Join(t.TempDir(), "data.rwfs"),
+		Encryption:    true,
+		EncryptionKey: "old",
+		KeyIterations: 1000,
+	}
+	fs, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := mutate(t, fs)
+	before := fs.KeyID()
+
+	if err := fs.RotateKey("wrong", "new"); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("wrong old key: error = %v, want ErrWrongKey", err)
+	}
+	if err := fs.RotateKey("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if fs.KeyID() == before {
+		t.Error("key ID did not change")
+	}
+	if fs.Config.EncryptionKey != "new" {
+		t.Errorf("configured key = %q, want %q", fs.Config.EncryptionKey, "new")
+	}
+	checkMutated(t, fs, big)
+
+	// The snapshot on disk was written under the new key
+	config.EncryptionKey = "new"
+	reopened, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMutated(t, reopened, big)
+	if reopened.KeyID() != fs.KeyID() {
+		t.Errorf("reopened key ID = %s, want %s", reopened.KeyID(), fs.KeyID())
+	}
+}
+
+func TestRotateKeyRollback(t *testing.T) {
+	dir := t.TempDir()
+	config := FileSystemConfig{
+		Filepath:      filepath.Join(dir, "data.rwfs"),
+		Encryption:    true,
+		EncryptionKey: "old",
+		KeyIterations: 1000,
+	}
+	fs, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := mutate(t, fs)
+	if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	before := fs.KeyID()
+
+	// The snapshot cannot be written, so the old key stays in use
+	fs.snapshotPath = filepath.Join(dir, "missing", "data.rwfs")
+	if err := fs.RotateKey("old", "new"); err == nil {
+		t.Fatal("RotateKey succeeded without writing the snapshot")
+	}
+	fs.snapshotPath = config.Filepath
+	if fs.KeyID() != before || fs.Config.EncryptionKey != "old" {
+		t.Errorf("key changed after a failed rotation: ID %s, configured %q", fs.KeyID(), fs.Config.EncryptionKey)
+	}
+	checkMutated(t, fs, big)
+	if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMutated(t, reopened, big)
+
+	// Once the snapshot under the new key replaced the old one, a later
+	// failure keeps the new key
+	journaled := config
+	journaled.Journal = true
+	journaled.JournalCompactSize = -1
+	fs, err = NewLocalFileSystem(journaled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := fs.journal.name
+	fs.journal.name = filepath.Join(dir, "missing", "data.rwfs.journal")
+	if err := fs.RotateKey("old", "new"); err == nil {
+		t.Fatal("RotateKey succeeded without resetting the journal")
+	}
+	fs.journal.name = name
+	if fs.Config.EncryptionKey != "new" {
+		t.Errorf("configured key = %q after the snapshot was replaced, want %q", fs.Config.EncryptionKey, "new")
+	}
+	fs.journal.close()
+	config.EncryptionKey = "new"
+	reopened, err = NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMutated(t, reopened, big)
+}
+
+func TestRotateRawKey(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, keySize), bytes.Repeat([]byte{2}, keySize)
+	fs, err := NewLocalFileSystem(FileSystemConfig{Encryption: true, EncryptionRawKey: oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := mutate(t, fs)
+	if err := fs.RotateKey("old", "new"); err == nil {
+		t.Error("RotateKey succeeded on a file system with a raw key")
+	}
+	if err := fs.RotateRawKey(newKey, oldKey); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("wrong old key: error = %v, want ErrWrongKey", err)
+	}
+	if err := fs.RotateRawKey(oldKey, newKey); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fs.Config.EncryptionRawKey, newKey) {
+		t.Error("configured raw key was not replaced")
+	}
+	checkMutated(t, fs, big)
+}
@@ -1,47 +1,164 @@
 package rwfs
 
 import (
+	iofs "io/fs"
+	"path"
 	"regexp"
+	"runtime"
+	"sort"
 	"sync"
+	"time"
 )
 
-// SearchResult represents a search result containing the name and whether it's a file or directory
+// SearchResult represents a search result with the full path and metadata of
+// the matching file or directory
 type SearchResult struct {
-	Name  string
-	IsDir bool
+	Name    string
+	Path    string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+	Owner   string
 }
 
-// Search searches for files and directories based on the provided pattern
+// SearchType restricts a search to files or directories
+type SearchType int
+
+const (
+	SearchAll SearchType = iota
+	SearchFiles
+	SearchDirs
+)
+
+// SearchOptions holds the filters applied by SearchTree. A zero value
+// disables the corresponding filter.
+type SearchOptions struct {
+	Pattern        string // regular expression matched against the entry name
+	Glob           string // path.Match pattern matched against the entry name
+	Type           SearchType
+	MinSize        int64
+	MaxSize        int64
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+	Owner          string
+	Workers        int // number of concurrent matchers, defaults to GOMAXPROCS
+}
+
+// Search recursively searches the current working directory for files and
+// directories whose name matches the provided regular expression
 func (fs *MemFileSystem) Search(pattern string) ([]SearchResult, error) {
+	return fs.SearchTree(".", SearchOptions{Pattern: pattern})
+}
+
+// SearchTree recursively searches the tree rooted at root for files and
+// directories matching all filters in opts. Results carry full paths and are
+// sorted by path. Directories that cannot be read are skipped.
+func (fs *MemFileSystem) SearchTree(root string, opts SearchOptions) ([]SearchResult, error) {
+	var re *regexp.Regexp
+	if opts.Pattern != "" {
+		var err error
+		if re, err = regexp.Compile(opts.Pattern); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Glob != "" {
+		if _, err := path.Match(opts.Glob, ""); err != nil {
+			return nil, err
+		}
+	}
 	fs.mu.RLock()
-	defer fs.mu.RUnlock()
+	root = fs.absPath(root)
+	fs.mu.RUnlock()
 
-	var results []SearchResult
-	re, err := regexp.Compile(pattern)
-	if err != nil {
-		return nil, err
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
 	}
 
-	var wg sync.WaitGroup
-	for name, file := range fs.CWD.Entries {
-		wg.Add(1)
-		go func(name string, file *MemFile) {
-			defer wg.Done()
-			if re.MatchString(name) {
-				results = append(results, SearchResult{Name: name, IsDir: false})
-			}
-		}(name, file)
+	type candidate struct {
+		path  string
+		entry iofs.DirEntry
 	}
-	for name, dir := range fs.CWD.Dirs {
+	candidates := make(chan candidate, workers)
+	var (
+		results []SearchResult
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go func(name string, dir *MemDirectory) {
+		go func() {
 			defer wg.Done()
-			if re.MatchString(name) {
-				results = append(results, SearchResult{Name: name, IsDir: true})
+			for c := range candidates {
+				if result, ok := opts.match(c.path, c.entry, re); ok {
+					mu.Lock()
+					results = append(results, result)
+					mu.Unlock()
+				}
 			}
-		}(name, dir)
+		}()
 	}
+
+	err := fs.WalkDir(root, func(name string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			if name == root {
+				return err
+			}
+			return nil
+		}
+		if name != root {
+			candidates <- candidate{path: name, entry: d}
+		}
+		return nil
+	})
+	close(candidates)
 	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
 
+	sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
 	return results, nil
 }
+
+// match applies the filters in opts to a single entry
+func (opts *SearchOptions) match(name string, d iofs.DirEntry, re *regexp.Regexp) (SearchResult, bool) {
+	if opts.Type == SearchFiles && d.IsDir() || opts.Type == SearchDirs && !d.IsDir() {
+		return SearchResult{}, false
+	}
+	if re != nil && !re.MatchString(d.Name()) {
+		return SearchResult{}, false
+	}
+	if opts.Glob != "" {
+		if ok, _ := path.Match(opts.Glob, d.Name()); !ok {
+			return SearchResult{}, false
+		}
+	}
+	info, err := d.Info()
+	if err != nil {
+		return SearchResult{}, false
+	}
+	result := SearchResult{
+		Name:    d.Name(),
+		Path:    name,
+		IsDir:   d.IsDir(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if mi, ok := info.(*MemFileInfo); ok {
+		result.Owner = mi.Owner()
+	}
+	if opts.MinSize > 0 && result.Size < opts.MinSize || opts.MaxSize > 0 && result.Size > opts.MaxSize {
+		return SearchResult{}, false
+	}
+	if !opts.ModifiedAfter.IsZero() && !result.ModTime.After(opts.ModifiedAfter) {
+		return SearchResult{}, false
+	}
+	if !opts.ModifiedBefore.IsZero() && !result.ModTime.Before(opts.ModifiedBefore) {
+		return SearchResult{}, false
+	}
+	if opts.Owner != "" && result.Owner != opts.Owner {
+		return SearchResult{}, false
+	}
+	return result, true
+}
@@ -0,0 +1,188 @@
+package rwfs
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newSearchTree returns a file system holding log files of several owners,
+// sizes and ages below /var and /home
+func newSearchTree(t *testing.T) *MemFileSystem {
+	t.Helper()
+	mem := NewMemFileSystem(FileSystemConfig{})
+	for _, dir := range []string{"/var/log/app", "/home/alice/logs"} {
+		if err := mem.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, f := range []struct {
+		name, owner string
+		size        int
+		old         bool
+	}{
+		{"/var/log/app/app.log", "root", 100, false},
+		{"/var/log/app/app.log.1", "root", 5000, true},
+		{"/var/log/syslog", "root", 10, false},
+		{"/home/alice/logs/debug.log", "alice", 2000, false},
+		{"/home/alice/notes.txt", "alice", 0, true},
+	} {
+		file, err := mem.CreateFile(f.name, f.owner, ReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write(make([]byte, f.size)); err != nil {
+			t.Fatal(err)
+		}
+		if f.old {
+			_, entry, err := mem.lookup(f.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry.modTime = old
+		}
+	}
+	return mem
+}
+
+// paths returns the paths of results
+func paths(results []SearchResult) []string {
+	var names []string
+	for _, result := range results {
+		names = append(names, result.Path)
+	}
+	return names
+}
+
+func TestSearchTree(t *testing.T) {
+	mem := newSearchTree(t)
+	cutoff := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name string
+		root string
+		opts SearchOptions
+		want []string
+	}{
+		{"pattern", "/", SearchOptions{Pattern: `\.log$`}, []string{"/home/alice/logs/debug.log", "/var/log/app/app.log"}},
+		{"glob", "/var", SearchOptions{Glob: "app*"}, []string{"/var/log/app", "/var/log/app/app.log", "/var/log/app/app.log.1"}},
+		{"files", "/home", SearchOptions{Type: SearchFiles}, []string{"/home/alice/logs/debug.log", "/home/alice/notes.txt"}},
+		{"dirs", "/home", SearchOptions{Type: SearchDirs}, []string{"/home/alice", "/home/alice/logs"}},
+		{"size", "/", SearchOptions{Type: SearchFiles, MinSize: 50, MaxSize: 2000}, []string{"/home/alice/logs/debug.log", "/var/log/app/app.log"}},
+		{"modified before", "/", SearchOptions{ModifiedBefore: cutoff}, []string{"/home/alice/notes.txt", "/var/log/app/app.log.1"}},
+		{"modified after", "/var/log/app", SearchOptions{ModifiedAfter: cutoff}, []string{"/var/log/app/app.log"}},
+		{"owner", "/", SearchOptions{Type: SearchFiles, Owner: "alice"}, []string{"/home/alice/logs/debug.log", "/home/alice/notes.txt"}},
+		{"relative root", "alice", SearchOptions{Glob: "*.txt"}, []string{"/home/alice/notes.txt"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := mem.ChangeDir("/home"); err != nil {
+				t.Fatal(err)
+			}
+			results, err := mem.SearchTree(test.root, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := paths(results); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("SearchTree(%s) = %v, want %v", test.root, got, test.want)
+			}
+		})
+	}
+
+	results, err := mem.SearchTree("/var", SearchOptions{Pattern: "^syslog$"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SearchResult{Name: "syslog", Path: "/var/log/syslog", Size: 10, Owner: "root"}
+	if len(results) != 1 || results[0].ModTime.IsZero() {
+		t.Fatalf("results = %v", results)
+	}
+	results[0].ModTime = time.Time{}
+	if results[0] != want {
+		t.Errorf("result = %+v, want %+v", results[0], want)
+	}
+
+	if _, err := mem.SearchTree("/", SearchOptions{Pattern: "("}); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+	if _, err := mem.SearchTree("/missing", SearchOptions{}); !os.IsNotExist(err) {
+		t.Errorf("missing root: error = %v, want not exist", err)
+	}
+}
+
+func TestSearchSkipsUnreadable(t *testing.T) {
+	mem := newSearchTree(t)
+	if err := mem.Chmod("/home/alice", 0300); err != nil {
+		t.Fatal(err)
+	}
+	results, err := mem.SearchTree("/", SearchOptions{Type: SearchFiles, Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Errorf("results below an unreadable directory: %v", paths(results))
+	}
+}
+
+func TestSearchConcurrentMutation(t *testing.T) {
+	mem := newSearchTree(t)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			name := fmt.Sprintf("/var/log/app/rotated-%d.log", i)
+			file, err := mem.CreateFile(name, "root", ReadWrite)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			file.Write([]byte("line\n"))
+			if i%2 == 0 {
+				if err := mem.RemoveFile(name); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if _, err := mem.SearchTree("/", SearchOptions{Glob: "*.log", Workers: 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	results, err := mem.SearchTree("/var/log/app", SearchOptions{Glob: "rotated-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 100 {
+		t.Errorf("found %d rotated logs, want 100", len(results))
+	}
+}
+
+func TestHandleStat(t *testing.T) {
+	mem := newSearchTree(t)
+	if err := mem.Link("/var/log/syslog", "/var/messages"); err != nil {
+		t.Fatal(err)
+	}
+	file, err := mem.Open("/var/messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, ok := info.(*MemFileInfo)
+	if !ok {
+		t.Fatalf("handle Stat returned %T, want *MemFileInfo", info)
+	}
+	if meta.Name() != "messages" || meta.Owner() != "root" || meta.StoredSize() != 10 {
+		t.Errorf("name %q, owner %q, stored size %d", meta.Name(), meta.Owner(), meta.StoredSize())
+	}
+}
@@ -1,15 +1,121 @@
 package rwfs
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"io"
 )
 
+const (
+	keySize              = 32
+	keySaltSize          = 16
+	keyIDSize            = 8
+	defaultKeyIterations = 600000
+
+	// maxKeyIterations bounds the iteration count, which snapshots store in
+	// their unauthenticated header, so that a tampered header cannot make
+	// loading take arbitrarily long
+	maxKeyIterations = 10000000
+)
+
+// masterKey is the key that wraps file data keys and encrypts snapshots and
+// the journal, together with the parameters it was derived with
+type masterKey struct {
+	key        []byte
+	salt       []byte // nil unless derived with PBKDF2
+	iterations int
+}
+
+// newMasterKey returns the master key for a new file system: the raw key if
+// one is configured, or else a key derived from the passphrase with a fresh
+// salt. It fails with ErrMasterKeyRequired if neither is configured.
+func newMasterKey(config FileSystemConfig) (*masterKey, error) {
+	if config.EncryptionRawKey != nil {
+		return rawMasterKey(config.EncryptionRawKey)
+	}
+	if config.EncryptionKey == "" {
+		return nil, ErrMasterKeyRequired
+	}
+	salt := make([]byte, keySaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	iterations := config.KeyIterations
+	if iterations <= 0 {
+		iterations = defaultKeyIterations
+	}
+	if iterations > maxKeyIterations {
+		return nil, ErrKeyIterations
+	}
+	return passphraseKey(config.EncryptionKey, salt, iterations), nil
+}
+
+// id returns the key ID of the master key in hexadecimal
+func (key *masterKey) id() string {
+	return hex.EncodeToString(keyID(key.key))
+}
+
+// keyID returns a fingerprint that identifies key without revealing it
+func keyID(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("rwfs key id"))
+	return mac.Sum(nil)[:keyIDSize]
+}
+
+// rawMasterKey returns a master key that is used as is
+func rawMasterKey(key []byte) (*masterKey, error) {
+	if len(key) != keySize {
+		return nil, ErrInvalidKey
+	}
+	return &masterKey{key: bytes.Clone(key)}, nil
+}
+
+// passphraseKey derives a master key from a passphrase with PBKDF2
+func passphraseKey(passphrase string, salt []byte, iterations int) *masterKey {
+	return &masterKey{
+		key:        pbkdf2Key([]byte(passphrase), salt, iterations, keySize),
+		salt:       salt,
+		iterations: iterations,
+	}
+}
+
+// pbkdf2Key derives a key of keyLen bytes from password with
+// PBKDF2-HMAC-SHA256 as specified in RFC 8018
+func pbkdf2Key(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	key := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, 0, hashLen)
+	t := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, uint32(block)))
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			subtle.XORBytes(t, t, u)
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
 // deriveKey creates a 32-byte key from the given encryption key using SHA-256.
+// It is only used for data written before keys were derived with PBKDF2.
 func deriveKey(key string) []byte {
 	hash := sha256.Sum256([]byte(key))
 	return hash[:]
@@ -17,7 +123,18 @@ func deriveKey(key string) []byte {
 
 // EncryptData encrypts data using AES with the given key.
 func EncryptData(data []byte, key string) ([]byte, error) {
-	block, err := aes.NewCipher(deriveKey(key))
+	return sealData(data, deriveKey(key))
+}
+
+// DecryptData decrypts data using AES with the given key.
+func DecryptData(data []byte, key string) ([]byte, error) {
+	return openData(data, deriveKey(key))
+}
+
+// sealData encrypts data with AES-256-GCM under a 32-byte key and prepends the
+// random nonce
+func sealData(data, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
@@ -35,9 +152,9 @@ func EncryptData(data []byte, key string) ([]byte, error) {
 	return gcm.Seal(nonce, nonce, data, nil), nil
 }
 
-// DecryptData decrypts data using AES with the given key.
-func DecryptData(data []byte, key string) ([]byte, error) {
-	block, err := aes.NewCipher(deriveKey(key))
+// openData decrypts data sealed by sealData
+func openData(data, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,62 @@
+package rwfs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+)
+
+func TestPBKDF2Vectors(t *testing.T) {
+	// RFC 7914 section 11, and the PBKDF2-HMAC-SHA256 counterparts of the
+	// RFC 6070 vectors
+	for _, test := range []struct {
+		password, salt string
+		iterations     int
+		key            string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"pass\x00word", "sa\x00lt", 4096, "89b69d0516f829893c696226650a8687"},
+	} {
+		want, err := hex.DecodeString(test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := pbkdf2Key([]byte(test.password), []byte(test.salt), test.iterations, len(want))
+		if !bytes.Equal(got, want) {
+			t.Errorf("pbkdf2Key(%q, %q, %d) = %x, want %x", test.password, test.salt, test.iterations, got, want)
+		}
+	}
+}
+
+func TestKeyIterationsStored(t *testing.T) {
+	config := FileSystemConfig{
+		Filepath:      filepath.Join(t.TempDir(), "data.rwfs"),
+		Encryption:    true,
+		EncryptionKey: "secret",
+		KeyIterations: 1000,
+	}
+	fs := writeVersions(t, config)
+	salt := fs.MemFileSystem.key.salt
+
+	// The iteration count is taken from the snapshot, not the configuration
+	config.KeyIterations = 2000
+	reopened, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := reopened.MemFileSystem.key
+	if key.iterations != 1000 || !bytes.Equal(key.salt, salt) {
+		t.Errorf("loaded key uses %d iterations and salt %x, want 1000 and %x", key.iterations, key.salt, salt)
+	}
+	if want := pbkdf2Key([]byte("secret"), salt, 1000, keySize); !bytes.Equal(key.key, want) {
+		t.Error("loaded key was not derived with the stored parameters")
+	}
+	if _, err := reopened.Stat("/v2"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,273 @@
+package rwfs
+
+import (
+	"encoding/gob"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// snapshotRecord is a single entry of a persisted directory tree. A snapshot
+// is a stream of records: every directory is written before its contents,
+// starting with the root, and the stream is terminated by a record with End
+// set. A file reachable through several hard links is written with its
+// contents once and referenced by FileID, its inode number, from every other
+// link. Binding is the tag binding encrypted contents to the snapshot, see
+// bindFile.
+//
+// Directories are saved with their Mode, Owner and Group. Permissions repeats
+// the owner bits of Mode; directories saved before permission modes existed
+// only have those.
+type snapshotRecord struct {
+	Path        string
+	IsDir       bool
+	Permissions DirPermission
+	Mode        os.FileMode
+	Owner       string
+	Group       string
+	ModTime     time.Time
+	FileID      uint64
+	File        *MemFile
+	Binding     []byte
+	End         bool
+}
+
+// fileBinding is the path a file was saved under and the tag binding its
+// contents to the snapshot
+type fileBinding struct {
+	path string
+	tag  []byte
+}
+
+// treeBinding holds the tags of the files of a decoded snapshot together with
+// its ID
+type treeBinding struct {
+	id    []byte
+	files map[*MemFile]fileBinding
+}
+
+// encodeTree writes the directory tree below root as a stream of snapshot
+// records, binding encrypted contents to the snapshot ID id
+func encodeTree(enc *gob.Encoder, root *MemDirectory, id []byte) error {
+	seen := make(map[*MemFile]bool)
+	if err := encodeDir(enc, root, "/", id, seen); err != nil {
+		return err
+	}
+	return enc.Encode(snapshotRecord{End: true})
+}
+
+func encodeDir(enc *gob.Encoder, dir *MemDirectory, dirPath string, id []byte, seen map[*MemFile]bool) error {
+	perm := ownerPermission(dir.mode)
+	err := enc.Encode(snapshotRecord{
+		Path:        dirPath,
+		IsDir:       true,
+		Permissions: DirPermission{Read: perm.Read, Write: perm.Write, Execute: perm.Execute, List: perm.Read},
+		Mode:        dir.mode,
+		Owner:       dir.owner,
+		Group:       dir.group,
+		ModTime:     dir.modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(dir.Entries))
+	for name := range dir.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		file := dir.Entries[name]
+		record := snapshotRecord{Path: path.Join(dirPath, name), FileID: file.ino}
+		if !seen[file] {
+			seen[file] = true
+			var err error
+			if record.File, record.Binding, err = bindFile(id, record.Path, file); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	names = names[:0]
+	for name := range dir.Dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := encodeDir(enc, dir.Dirs[name], path.Join(dirPath, name), id, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeTree reads a stream of snapshot records and rebuilds the directory
+// tree they describe, returning its root and the bindings of its files
+func decodeTree(dec *gob.Decoder) (*MemDirectory, map[*MemFile]fileBinding, error) {
+	root := NewMemDirectory("/", Exec&^defaultUmask)
+	dirs := map[string]*MemDirectory{"/": root}
+	files := make(map[uint64]*MemFile)
+	bindings := make(map[*MemFile]fileBinding)
+
+	for {
+		var record snapshotRecord
+		if err := dec.Decode(&record); err != nil {
+			return nil, nil, err
+		}
+		if record.End {
+			return root, bindings, nil
+		}
+
+		dirName, base := path.Split(record.Path)
+		parent := root
+		if record.Path != "/" {
+			var exists bool
+			if parent, exists = dirs[path.Clean(dirName)]; !exists {
+				return nil, nil, errors.New("corrupt snapshot: missing parent directory for " + record.Path)
+			}
+		}
+
+		switch {
+		case record.IsDir:
+			mode := record.Mode
+			if mode == 0 {
+				mode = legacyMode(record.Permissions.Mode())
+			}
+			dir := root
+			if record.Path != "/" {
+				dir = NewMemDirectory(base, mode)
+				dir.parent = parent
+				parent.Dirs[base] = dir
+			}
+			dir.mode = mode
+			dir.owner, dir.group = record.Owner, record.Group
+			dir.modTime = record.ModTime
+			dirs[record.Path] = dir
+		case record.File != nil:
+			record.File.refCount = 1
+			record.File.ino = record.FileID
+			files[record.FileID] = record.File
+			bindings[record.File] = fileBinding{path: record.Path, tag: record.Binding}
+			parent.Entries[base] = record.File
+		default:
+			file, exists := files[record.FileID]
+			if !exists {
+				return nil, nil, errors.New("corrupt snapshot: unknown hard link target for " + record.Path)
+			}
+			file.refCount++
+			parent.Entries[base] = file
+		}
+	}
+}
+
+// replaceTree installs root as the new directory tree, resetting the current
+// working directory and the cache. key is the master key the tree was saved
+// with, and becomes the master key of the file system if it has none yet.
+// binding holds the tags of the files, or is nil for snapshots that are not
+// encrypted or were written before contents were bound to them. It fails if the data keys of the files cannot
+// be unwrapped or their tags do not match, leaving the current tree in place.
+func (fs *MemFileSystem) replaceTree(root *MemDirectory, key *masterKey, binding *treeBinding) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.mutable(); err != nil {
+		return err
+	}
+
+	adopted := fs.key == nil && key != nil
+	if adopted {
+		fs.key = key
+	}
+	if err := fs.unsealTree(root, key, binding); err != nil {
+		if adopted {
+			fs.key = nil
+		}
+		return err
+	}
+
+	fs.RootDir = root
+	fs.CWD = root
+	fs.Cache = NewFileCache()
+
+	// Continue numbering after the highest inode number in the tree, and
+	// number the files of snapshots that did not store one
+	fs.nextIno = 0
+	var unnumbered []*MemFile
+	forEachFile(root, func(file *MemFile) {
+		if file.ino == 0 {
+			unnumbered = append(unnumbered, file)
+		} else if file.ino > fs.nextIno {
+			fs.nextIno = file.ino
+		}
+	})
+	for _, file := range unnumbered {
+		if file.ino == 0 {
+			fs.nextIno++
+			file.ino = fs.nextIno
+		}
+	}
+	return nil
+}
+
+// cloneTree returns a deep copy of the directory tree below root in which
+// hard links still share a single file, together with the copy of every
+// file; the caller must hold the read lock. The copies share plain contents
+// with the originals until releaseTree is called, which is done here if an
+// error is returned.
+func cloneTree(root *MemDirectory) (*MemDirectory, map[*MemFile]*MemFile, error) {
+	files := make(map[*MemFile]*MemFile)
+	clone, err := cloneDir(root, nil, files)
+	if err != nil {
+		releaseTree(files)
+		return nil, nil, err
+	}
+	return clone, files, nil
+}
+
+// releaseTree ends sharing contents with the copies returned by cloneTree
+func releaseTree(files map[*MemFile]*MemFile) {
+	for file, copied := range files {
+		file.release(copied)
+	}
+}
+
+func cloneDir(dir, parent *MemDirectory, files map[*MemFile]*MemFile) (*MemDirectory, error) {
+	clone := NewMemDirectory(dir.Name, dir.mode)
+	clone.owner, clone.group = dir.owner, dir.group
+	clone.parent = parent
+	clone.modTime = dir.modTime
+	for name, file := range dir.Entries {
+		copied, exists := files[file]
+		if !exists {
+			var err error
+			if copied, err = file.clone(); err != nil {
+				return nil, err
+			}
+			files[file] = copied
+		}
+		clone.Entries[name] = copied
+	}
+	for name, sub := range dir.Dirs {
+		var err error
+		if clone.Dirs[name], err = cloneDir(sub, clone, files); err != nil {
+			return nil, err
+		}
+	}
+	return clone, nil
+}
+
+// forEachFile calls fn for every file entry below dir. A file with several
+// hard links is visited once per link.
+func forEachFile(dir *MemDirectory, fn func(*MemFile)) {
+	for _, file := range dir.Entries {
+		fn(file)
+	}
+	for _, sub := range dir.Dirs {
+		forEachFile(sub, fn)
+	}
+}
@@ -0,0 +1,420 @@
+package rwfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// saveSnapshot fills a file system created with config using mutate and
+// returns a snapshot of it together with the expected large file contents
+func saveSnapshot(t *testing.T, config FileSystemConfig) ([]byte, []byte) {
+	t.Helper()
+	fs, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := mutate(t, fs)
+	var buf bytes.Buffer
+	if err := fs.SaveTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), big
+}
+
+// loadSnapshot loads data into a file system created with config that holds
+// a single file, and checks that the file is still there if loading fails
+func loadSnapshot(t *testing.T, config FileSystemConfig, data []byte) (*LocalFileSystem, error) {
+	t.Helper()
+	fs, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.CreateFile("/before.txt", "", ReadWrite); err != nil {
+		t.Fatal(err)
+	}
+	err = fs.LoadFrom(bytes.NewReader(data))
+	if err != nil {
+		if _, serr := fs.Stat("/before.txt"); serr != nil {
+			t.Errorf("failed load replaced the tree: %v", serr)
+		}
+	}
+	return fs, err
+}
+
+// payloadOffset returns the offset of the payload of a snapshot
+func payloadOffset(data []byte) int {
+	return snapshotHeaderSize + int(binary.BigEndian.Uint32(data[8:]))
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, test := range testConfigs {
+		t.Run(test.name, func(t *testing.T) {
+			data, big := saveSnapshot(t, test.config)
+			fs, err := loadSnapshot(t, test.config, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkMutated(t, fs, big)
+			if _, err := fs.Stat("/before.txt"); err == nil {
+				t.Error("loading kept a file that is not in the snapshot")
+			}
+		})
+	}
+}
+
+func TestSnapshotTampered(t *testing.T) {
+	for _, test := range testConfigs {
+		t.Run(test.name, func(t *testing.T) {
+			data, _ := saveSnapshot(t, test.config)
+			for _, offset := range []int{payloadOffset(data), len(data) / 2, len(data) - 1} {
+				tampered := bytes.Clone(data)
+				tampered[offset] ^= 0x40
+				if _, err := loadSnapshot(t, test.config, tampered); !errors.Is(err, ErrSnapshotChecksum) {
+					t.Errorf("byte %d flipped: error = %v, want ErrSnapshotChecksum", offset, err)
+				}
+			}
+		})
+	}
+}
+
+// blockingWriter blocks every write until release is closed
+type blockingWriter struct {
+	writing chan struct{}
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case w.writing <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return w.buf.Write(p)
+}
+
+func TestSnapshotSlowWriter(t *testing.T) {
+	fs, err := NewLocalFileSystem(FileSystemConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := mutate(t, fs)
+	w := &blockingWriter{writing: make(chan struct{}, 1), release: make(chan struct{})}
+	saved := make(chan error)
+	go func() { saved <- fs.SaveTo(w) }()
+	<-w.writing
+
+	// The stream is stuck, but the file system can still be used, and
+	// changes made now are not part of the snapshot
+	file, err := fs.CreateFile("/later.txt", "", ReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("later")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/later", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, "/docs/old/b.txt"); string(got) != "hello world" {
+		t.Errorf("b.txt = %q while saving", got)
+	}
+	close(w.release)
+	if err := <-saved; err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadSnapshot(t, FileSystemConfig{}, w.buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMutated(t, loaded, big)
+	if _, err := loaded.Stat("/later.txt"); !os.IsNotExist(err) {
+		t.Errorf("file created while saving: Stat error = %v, want not exist", err)
+	}
+}
+
+func TestSnapshotTruncated(t *testing.T) {
+	for _, test := range testConfigs {
+		t.Run(test.name, func(t *testing.T) {
+			data, _ := saveSnapshot(t, test.config)
+			payload := payloadOffset(data)
+			for _, size := range []int{8, payload, payload + 1, len(data) / 2, len(data) - sha256.Size, len(data) - 1} {
+				_, err := loadSnapshot(t, test.config, data[:size])
+				if !errors.Is(err, ErrSnapshotCorrupt) && !errors.Is(err, ErrSnapshotChecksum) {
+					t.Errorf("cut to %d bytes: error = %v, want ErrSnapshotCorrupt or ErrSnapshotChecksum", size, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSnapshotVersion(t *testing.T) {
+	data, _ := saveSnapshot(t, FileSystemConfig{})
+	for _, version := range []uint16{0, snapshotVersion + 1, 0xffff} {
+		changed := bytes.Clone(data)
+		binary.BigEndian.PutUint16(changed[4:], version)
+		if _, err := loadSnapshot(t, FileSystemConfig{}, changed); !errors.Is(err, ErrSnapshotVersion) {
+			t.Errorf("version %d: error = %v, want ErrSnapshotVersion", version, err)
+		}
+	}
+}
+
+func TestSnapshotExtensionSize(t *testing.T) {
+	// A header claiming a huge extension area is refused before the area is
+	// allocated
+	for _, size := range []uint32{maxExtensionSize + 1, 0xffffffff} {
+		header := []byte(snapshotMagic)
+		header = binary.BigEndian.AppendUint16(header, snapshotVersion)
+		header = binary.BigEndian.AppendUint16(header, 0)
+		header = binary.BigEndian.AppendUint32(header, size)
+		if _, err := loadSnapshot(t, FileSystemConfig{}, header); !errors.Is(err, ErrSnapshotCorrupt) {
+			t.Errorf("extension area of %d bytes: error = %v, want ErrSnapshotCorrupt", size, err)
+		}
+	}
+}
+
+// extensionOffset returns the offset of the value of the extension tag in a
+// snapshot, or -1 if it has none
+func extensionOffset(data []byte, tag uint8) int {
+	for off := snapshotHeaderSize; off < payloadOffset(data); {
+		size := int(binary.BigEndian.Uint16(data[off+1:]))
+		if data[off] == tag {
+			return off + 3
+		}
+		off += 3 + size
+	}
+	return -1
+}
+
+func TestSnapshotTamperedHeader(t *testing.T) {
+	// Header fields are covered by the checksum, so damage to them is
+	// reported as such instead of loading with a wrong journal position or
+	// looking like another key or codec
+	config := FileSystemConfig{
+		Filepath:      filepath.Join(t.TempDir(), "data.rwfs"),
+		Journal:       true,
+		Compression:   true,
+		Encryption:    true,
+		EncryptionKey: "secret",
+		KeyIterations: 1000,
+	}
+	fs, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutate(t, fs)
+	if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(config.Filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offsets := map[string]int{"flags": 7}
+	for name, tag := range map[string]uint8{"journal seq": extJournalSeq, "codec": extCodec, "salt": extKDF, "key ID": extKeyID} {
+		if offsets[name] = extensionOffset(data, tag); offsets[name] < 0 {
+			t.Fatalf("snapshot has no %s", name)
+		}
+	}
+	for name, offset := range offsets {
+		tampered := bytes.Clone(data)
+		tampered[offset] ^= 0x01
+		if err := os.WriteFile(config.Filepath, tampered, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewLocalFileSystem(config); !errors.Is(err, ErrSnapshotChecksum) {
+			t.Errorf("%s flipped: error = %v, want ErrSnapshotChecksum", name, err)
+		}
+	}
+}
+
+func TestSnapshotVersion2(t *testing.T) {
+	// Version 2 snapshots only checksum the payload
+	data, big := saveSnapshot(t, FileSystemConfig{Compression: true})
+	start, end := payloadOffset(data), len(data)-sha256.Size
+	binary.BigEndian.PutUint16(data[4:], 2)
+	checksum := sha256.Sum256(data[start:end])
+	copy(data[end:], checksum[:])
+	fs, err := loadSnapshot(t, FileSystemConfig{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMutated(t, fs, big)
+}
+
+func TestSnapshotTamperedWithChecksum(t *testing.T) {
+	// The checksum only detects accidental corruption. An attacker can fix
+	// it up, so encrypted snapshots rely on authenticated encryption.
+	config := FileSystemConfig{Encryption: true, EncryptionKey: "secret", KeyIterations: 1000}
+	data, _ := saveSnapshot(t, config)
+	start, end := payloadOffset(data), len(data)-sha256.Size
+	for _, offset := range []int{start + 20, (start + end) / 2, end - 1} {
+		tampered := bytes.Clone(data)
+		tampered[offset] ^= 0x40
+		checksum := sha256.Sum256(tampered[:end])
+		copy(tampered[end:], checksum[:])
+		if _, err := loadSnapshot(t, config, tampered); !errors.Is(err, ErrDecryptFailed) {
+			t.Errorf("byte %d flipped: error = %v, want ErrDecryptFailed", offset, err)
+		}
+	}
+}
+
+func TestSnapshotKeys(t *testing.T) {
+	encrypted := FileSystemConfig{Encryption: true, EncryptionKey: "secret", KeyIterations: 1000}
+	data, _ := saveSnapshot(t, encrypted)
+
+	wrong := encrypted
+	wrong.EncryptionKey = "wrong"
+	_, err := loadSnapshot(t, wrong, data)
+	var mismatch *KeyMismatchError
+	if !errors.As(err, &mismatch) || !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("wrong key: error = %v, want KeyMismatchError", err)
+	}
+	if _, err := loadSnapshot(t, FileSystemConfig{}, data); !errors.Is(err, ErrKeyRequired) {
+		t.Errorf("no key: error = %v, want ErrKeyRequired", err)
+	}
+}
+
+func TestSnapshotMigrate(t *testing.T) {
+	encrypted := FileSystemConfig{Encryption: true, EncryptionKey: "secret", KeyIterations: 1000}
+	plain, big := saveSnapshot(t, FileSystemConfig{})
+	if _, err := loadSnapshot(t, encrypted, plain); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("unencrypted snapshot: error = %v, want ErrNotEncrypted", err)
+	}
+	migrate := encrypted
+	migrate.MigrateSnapshots = true
+	fs, err := loadSnapshot(t, migrate, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMutated(t, fs, big)
+	fs.mu.RLock()
+	forEachFile(fs.RootDir, func(file *MemFile) {
+		if !file.data.versioned() {
+			t.Errorf("%s was not encrypted on migration", file.Name)
+		}
+	})
+	fs.mu.RUnlock()
+}
+
+func TestSnapshotBinding(t *testing.T) {
+	config := FileSystemConfig{Encryption: true, EncryptionKey: "secret", KeyIterations: 1000}
+	fs, err := NewLocalFileSystem(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string][]byte{"/a": pattern(blockSize+10, 1), "/b": pattern(blockSize+10, 2)} {
+		file, err := fs.CreateFile(name, "", ReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write(contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// encode returns the records of the tree saved as the snapshot id
+	encode := func(id []byte) []snapshotRecord {
+		var buf bytes.Buffer
+		fs.MemFileSystem.mu.RLock()
+		err := encodeTree(gob.NewEncoder(&buf), fs.RootDir, id)
+		fs.MemFileSystem.mu.RUnlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var records []snapshotRecord
+		dec := gob.NewDecoder(&buf)
+		for {
+			var record snapshotRecord
+			if err := dec.Decode(&record); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, record)
+			if record.End {
+				return records
+			}
+		}
+	}
+	// load decodes records into a fresh file system as the snapshot id
+	load := func(records []snapshotRecord, id []byte) (*MemFileSystem, error) {
+		var buf bytes.Buffer
+		enc := gob.NewEncoder(&buf)
+		for _, record := range records {
+			if err := enc.Encode(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+		root, files, err := decodeTree(gob.NewDecoder(&buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded := newMemFileSystem(config)
+		return loaded, loaded.replaceTree(root, fs.MemFileSystem.key, &treeBinding{id: id, files: files})
+	}
+	index := func(records []snapshotRecord, path string) int {
+		for i, record := range records {
+			if record.Path == path {
+				return i
+			}
+		}
+		t.Fatalf("no record for %s", path)
+		return -1
+	}
+
+	id := bytes.Repeat([]byte{1}, snapshotIDSize)
+	if _, err := load(encode(id), id); err != nil {
+		t.Fatal(err)
+	}
+
+	var integrity *IntegrityError
+	if _, err := load(encode(id), bytes.Repeat([]byte{2}, snapshotIDSize)); !errors.As(err, &integrity) {
+		t.Errorf("replayed into another snapshot: error = %v, want IntegrityError", err)
+	}
+
+	records := encode(id)
+	a, b := index(records, "/a"), index(records, "/b")
+	records[a].File, records[b].File = records[b].File, records[a].File
+	if _, err := load(records, id); !errors.As(err, &integrity) {
+		t.Errorf("contents swapped: error = %v, want IntegrityError", err)
+	}
+
+	records = encode(id)
+	records[a].File, records[b].File = records[b].File, records[a].File
+	records[a].Binding, records[b].Binding = records[b].Binding, records[a].Binding
+	if _, err := load(records, id); !errors.As(err, &integrity) {
+		t.Errorf("contents and tags swapped: error = %v, want IntegrityError", err)
+	}
+
+	// Roll the first block back to an older version. Only the last block is
+	// opened on load, so the rollback shows when the block is read.
+	old := encode(id)
+	file, err := fs.OpenFileFlags("/a", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.(*FileHandle).WriteAt([]byte("new"), 0); err != nil {
+		t.Fatal(err)
+	}
+	records = encode(id)
+	a = index(records, "/a")
+	records[a].File.data.blocks[0] = old[index(old, "/a")].File.data.blocks[0]
+	loaded, err := load(records, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.RootDir.Entries["a"].ReadAt(make([]byte, 10), 0); !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("block rolled back: error = %v, want ErrDecryptFailed", err)
+	}
+}
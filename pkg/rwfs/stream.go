@@ -0,0 +1,188 @@
+package rwfs
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Streaming encryption
+//
+// Large payloads are encrypted in segments following the STREAM construction.
+// The stream starts with a random nonce prefix, followed by the sealed
+// segments. Every segment holds streamChunkSize bytes of plaintext, except the
+// last one which may be shorter or even empty. The nonce of a segment is the
+// prefix, a 32-bit big endian segment counter and a final byte that is 1 for
+// the last segment and 0 otherwise. Reordered, dropped or truncated segments
+// therefore fail authentication.
+const (
+	streamChunkSize   = 64 << 10
+	streamPrefixSize  = 7
+	streamMaxSegments = 1<<32 - 1
+)
+
+func newStreamAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// streamNonce builds the nonce of segment counter
+func streamNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, streamPrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// streamWriter encrypts everything written to it into a segmented stream
+type streamWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	closed  bool
+}
+
+// newStreamWriter starts an encrypted stream on w. Close must be called to
+// seal the final segment.
+func newStreamWriter(w io.Writer, key []byte) (*streamWriter, error) {
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, streamPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &streamWriter{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		buf:    make([]byte, 0, streamChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("write to closed stream")
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more data follows, so that the
+		// segment written by Close is always the last one
+		if len(s.buf) == streamChunkSize {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):streamChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last segment. It does not close the underlying writer.
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.seal(true)
+}
+
+func (s *streamWriter) seal(last bool) error {
+	if s.counter == streamMaxSegments {
+		return errors.New("stream too large")
+	}
+	sealed := s.aead.Seal(s.buf[:0], streamNonce(s.prefix, s.counter, last), s.buf, nil)
+	s.counter++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// streamReader decrypts a segmented stream written by streamWriter
+type streamReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	sealed  []byte
+	plain   []byte
+	done    bool
+}
+
+// newStreamReader starts decrypting the stream read from r
+func newStreamReader(r io.Reader, key []byte) (*streamReader, error) {
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, streamPrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, ErrSnapshotCorrupt
+	}
+	return &streamReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		prefix: prefix,
+		sealed: make([]byte, streamChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+// next reads and opens the following segment
+func (s *streamReader) next() error {
+	n, err := io.ReadFull(s.r, s.sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			// The stream ended without a final segment
+			return ErrDecryptFailed
+		}
+		return err
+	}
+	// The segment is the last one if nothing follows it
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, err := s.r.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+	plain, err := s.aead.Open(s.sealed[:0], streamNonce(s.prefix, s.counter, last), s.sealed[:n], nil)
+	if err != nil {
+		return ErrDecryptFailed
+	}
+	s.counter++
+	s.plain = plain
+	s.done = last
+	return nil
+}
@@ -0,0 +1,73 @@
+package rwfs
+
+import (
+	iofs "io/fs"
+	"path"
+	"path/filepath"
+)
+
+// WalkDir walks the tree rooted at root, calling fn for each file or
+// directory, including root. Entries are visited in lexical order and fn may
+// return fs.SkipDir or fs.SkipAll, as with fs.WalkDir.
+//
+// The file system is only locked while a directory is being read, never while
+// fn runs, so fn may call back into the file system and other goroutines may
+// keep modifying it. Changes made during the walk may or may not be seen.
+func (fs *MemFileSystem) WalkDir(root string, fn iofs.WalkDirFunc) error {
+	info, err := fs.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = fs.walk(root, iofs.FileInfoToDirEntry(info), fn)
+	}
+	if err == iofs.SkipDir || err == iofs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// Walk walks the tree rooted at root like WalkDir, but calls fn with the
+// os.FileInfo of every entry, as with filepath.Walk
+func (fs *MemFileSystem) Walk(root string, fn filepath.WalkFunc) error {
+	return fs.WalkDir(root, func(name string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return fn(name, nil, err)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return fn(name, nil, err)
+		}
+		return fn(name, info, nil)
+	})
+}
+
+// walk visits name and, if it is a directory, its children recursively
+func (fs *MemFileSystem) walk(name string, d iofs.DirEntry, fn iofs.WalkDirFunc) error {
+	if err := fn(name, d, nil); err != nil || !d.IsDir() {
+		if err == iofs.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := fs.ReadDir(name)
+	if err != nil {
+		// Report the error a second time, allowing fn to skip the directory
+		if err = fn(name, d, err); err != nil {
+			if err == iofs.SkipDir {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		if err := fs.walk(path.Join(name, entry.Name()), entry, fn); err != nil {
+			if err == iofs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package rwfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"testing"
+)
+
+// walkNames walks mem from root and returns the visited names; fn decides
+// what to return for each of them
+func walkNames(t *testing.T, mem *MemFileSystem, root string, fn func(name string) error) []string {
+	t.Helper()
+	var names []string
+	err := mem.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		names = append(names, name)
+		return fn(name)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestWalkDirSkip(t *testing.T) {
+	mem := newTestTree(t)
+	if _, err := mem.CreateFile("/a/m.txt", "", ReadWrite); err != nil {
+		t.Fatal(err)
+	}
+	returns := func(at string, err error) func(string) error {
+		return func(name string) error {
+			if name == at {
+				return err
+			}
+			return nil
+		}
+	}
+	for _, test := range []struct {
+		name string
+		fn   func(string) error
+		want []string
+	}{
+		{"all", returns("", nil), []string{"/", "/a", "/a/b", "/a/b/c.txt", "/a/link.txt", "/a/m.txt", "/empty", "/top.txt"}},
+		{"SkipDir on a directory", returns("/a/b", fs.SkipDir), []string{"/", "/a", "/a/b", "/a/link.txt", "/a/m.txt", "/empty", "/top.txt"}},
+		{"SkipDir on a file", returns("/a/link.txt", fs.SkipDir), []string{"/", "/a", "/a/b", "/a/b/c.txt", "/a/link.txt", "/empty", "/top.txt"}},
+		{"SkipDir on the root", returns("/", fs.SkipDir), []string{"/"}},
+		{"SkipAll", returns("/a/b/c.txt", fs.SkipAll), []string{"/", "/a", "/a/b", "/a/b/c.txt"}},
+	} {
+		if got := walkNames(t, mem, "/", test.fn); !slices.Equal(got, test.want) {
+			t.Errorf("%s: visited %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWalkErrors(t *testing.T) {
+	mem := newTestTree(t)
+	if err := mem.Chmod("/a", 0300); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unreadable directory is reported a second time with the error, and
+	// the walk goes on past it
+	var visited []string
+	var denied error
+	err := mem.Walk("/", func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			denied = err
+			return nil
+		}
+		if name == "/top.txt" && info.Size() != 3 {
+			t.Errorf("top.txt size = %d, want 3", info.Size())
+		}
+		visited = append(visited, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(denied, fs.ErrPermission) {
+		t.Errorf("unreadable directory: error = %v, want fs.ErrPermission", denied)
+	}
+	if want := []string{"/", "/a", "/empty", "/top.txt"}; !slices.Equal(visited, want) {
+		t.Errorf("visited %v, want %v", visited, want)
+	}
+
+	// Errors returned by fn end the walk, and a missing root is passed to fn
+	stop := errors.New("stop")
+	if err := mem.Walk("/", func(string, os.FileInfo, error) error { return stop }); err != stop {
+		t.Errorf("Walk error = %v, want the error returned by fn", err)
+	}
+	err = mem.WalkDir("/missing", func(name string, d fs.DirEntry, err error) error {
+		return err
+	})
+	if !os.IsNotExist(err) {
+		t.Errorf("WalkDir of a missing root: error = %v, want not exist", err)
+	}
+}